@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v3"
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisign signature algorithms: "Ed" signs the file itself, while "ED"
+// (the default since minisign 0.8) signs its BLAKE2b-512 digest
+const (
+	minisignAlgLegacy    = "Ed"
+	minisignAlgPrehashed = "ED"
+)
+
+type minisignPublicKey struct {
+	keyID [8]byte
+	key   ed25519.PublicKey
+}
+
+type minisignSignature struct {
+	algorithm      string
+	keyID          [8]byte
+	signature      []byte
+	trustedComment string
+	globalSig      []byte
+}
+
+func sigFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.BoolFlag{Name: "verify-sig", Usage: "verify the archive's minisign signature before reading it"},
+		&cli.StringFlag{Name: "sig", Usage: "detached signature file (default: <archive>.minisig)"},
+		&cli.StringFlag{Name: "pubkey", Usage: "minisign public key, or a file containing it"},
+	}
+}
+
+// verifySignature checks the detached minisign signature of the archive at
+// path when --verify-sig is set. This authenticates the archive file as a
+// whole, and is unrelated to any per-entry checksums.
+func verifySignature(c *cli.Command, path string) error {
+	if !c.Bool("verify-sig") {
+		return nil
+	}
+	if c.String("pubkey") == "" {
+		return errors.New("--verify-sig requires --pubkey")
+	}
+	pk, err := readMinisignPublicKey(c.String("pubkey"))
+	if err != nil {
+		return fmt.Errorf("reading public key: %w", err)
+	}
+	sigPath := c.String("sig")
+	if sigPath == "" {
+		sigPath = path + ".minisig"
+	}
+	sigData, err := os.ReadFile(sigPath)
+	if err != nil {
+		return fmt.Errorf("reading signature: %w", err)
+	}
+	sig, err := parseMinisignSignature(sigData)
+	if err != nil {
+		return fmt.Errorf("parsing signature %s: %w", sigPath, err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := sig.verify(pk, f); err != nil {
+		return fmt.Errorf("signature verification failed for %s: %w", path, err)
+	}
+	return nil
+}
+
+// readMinisignPublicKey accepts either the base64 key itself (as given to
+// `minisign -P`) or the path to a minisign public key file
+func readMinisignPublicKey(s string) (*minisignPublicKey, error) {
+	encoded := s
+	if data, err := os.ReadFile(s); err == nil {
+		encoded = ""
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "untrusted comment:") {
+				encoded = line
+				break
+			}
+		}
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != 2+8+ed25519.PublicKeySize || string(raw[:2]) != minisignAlgLegacy {
+		return nil, errors.New("not a minisign public key")
+	}
+	pk := &minisignPublicKey{key: ed25519.PublicKey(raw[10:])}
+	copy(pk.keyID[:], raw[2:10])
+	return pk, nil
+}
+
+func parseMinisignSignature(data []byte) (*minisignSignature, error) {
+	var lines []string
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		lines = append(lines, strings.TrimRight(sc.Text(), "\r"))
+	}
+	if len(lines) < 4 {
+		return nil, errors.New("truncated signature file")
+	}
+	raw, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != 2+8+ed25519.SignatureSize {
+		return nil, errors.New("invalid signature length")
+	}
+	trusted, ok := strings.CutPrefix(lines[2], "trusted comment: ")
+	if !ok {
+		return nil, errors.New("missing trusted comment")
+	}
+	globalSig, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil {
+		return nil, err
+	}
+	if len(globalSig) != ed25519.SignatureSize {
+		return nil, errors.New("invalid global signature length")
+	}
+	sig := &minisignSignature{
+		algorithm:      string(raw[:2]),
+		signature:      raw[10:],
+		trustedComment: trusted,
+		globalSig:      globalSig,
+	}
+	copy(sig.keyID[:], raw[2:10])
+	return sig, nil
+}
+
+func (sig *minisignSignature) verify(pk *minisignPublicKey, r io.Reader) error {
+	if sig.keyID != pk.keyID {
+		return fmt.Errorf("signed with key %X, not %X", sig.keyID, pk.keyID)
+	}
+	var msg []byte
+	switch sig.algorithm {
+	case minisignAlgPrehashed:
+		h, err := blake2b.New512(nil)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(h, r); err != nil {
+			return err
+		}
+		msg = h.Sum(nil)
+	case minisignAlgLegacy:
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		msg = data
+	default:
+		return fmt.Errorf("unsupported signature algorithm %q", sig.algorithm)
+	}
+	if !ed25519.Verify(pk.key, msg, sig.signature) {
+		return errors.New("invalid signature")
+	}
+	if !ed25519.Verify(pk.key, append(append([]byte{}, sig.signature...), sig.trustedComment...), sig.globalSig) {
+		return errors.New("invalid trusted comment signature")
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisignKey is a key pair for signing test archives as minisign would.
+type minisignKey struct {
+	id   [8]byte
+	priv ed25519.PrivateKey
+	pub  string
+}
+
+func newMinisignKey(t *testing.T, id string) minisignKey {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := minisignKey{priv: priv}
+	copy(k.id[:], id)
+	k.pub = base64.StdEncoding.EncodeToString(append(append([]byte(minisignAlgLegacy), k.id[:]...), pub...))
+	return k
+}
+
+// sign writes path's detached signature to path.minisig, with the
+// algorithm alg and the trusted comment comment.
+func (k minisignKey) sign(t *testing.T, path, alg, comment string) {
+	t.Helper()
+	msg, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alg == minisignAlgPrehashed {
+		sum := blake2b.Sum512(msg)
+		msg = sum[:]
+	}
+	sig := ed25519.Sign(k.priv, msg)
+	global := ed25519.Sign(k.priv, append(append([]byte{}, sig...), comment...))
+	enc := base64.StdEncoding.EncodeToString
+	data := "untrusted comment: signature from minisign secret key\n" +
+		enc(append(append([]byte(alg), k.id[:]...), sig...)) + "\n" +
+		"trusted comment: " + comment + "\n" +
+		enc(global) + "\n"
+	if err := os.WriteFile(path+".minisig", []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	dir := t.TempDir()
+	key := newMinisignKey(t, "xpldtest")
+	pubFile := filepath.Join(dir, "key.pub")
+	if err := os.WriteFile(pubFile, []byte("untrusted comment: minisign public key\n"+key.pub+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	archive := writeTar(t, filepath.Join(dir, "a.tar"), tarFile("f", "signed\n"))
+	// run verifies the archive with both extract and inspect, which must
+	// agree, and returns inspect's error
+	run := func(pubkey string, args ...string) error {
+		t.Helper()
+		_, xErr := runXpld(t, nil, append(append([]string{"extract", "--verify-sig", "--pubkey", pubkey, "-o", t.TempDir()}, args...), archive)...)
+		_, err := runXpld(t, nil, append(append([]string{"inspect", "--verify-sig", "--pubkey", pubkey}, args...), archive)...)
+		if (xErr == nil) != (err == nil) {
+			t.Errorf("extract returned %v but inspect returned %v", xErr, err)
+		}
+		return err
+	}
+
+	// The key is taken either as given to minisign -P or from its file
+	for _, alg := range []string{minisignAlgPrehashed, minisignAlgLegacy} {
+		key.sign(t, archive, alg, "timestamp:1709294400")
+		for _, pubkey := range []string{key.pub, pubFile} {
+			if err := run(pubkey); err != nil {
+				t.Errorf("%s signature with key %s: %v", alg, pubkey, err)
+			}
+		}
+	}
+
+	// A signature kept elsewhere is found with --sig
+	key.sign(t, archive, minisignAlgPrehashed, "timestamp:1709294400")
+	moved := filepath.Join(dir, "moved.minisig")
+	if err := os.Rename(archive+".minisig", moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(key.pub, "--sig", moved); err != nil {
+		t.Errorf("signature given with --sig: %v", err)
+	}
+	if err := run(key.pub); err == nil {
+		t.Error("verification succeeded without a signature")
+	}
+
+	for _, alg := range []string{minisignAlgPrehashed, minisignAlgLegacy} {
+		// The archive changed after it was signed
+		writeTar(t, archive, tarFile("f", "signed\n"))
+		key.sign(t, archive, alg, "timestamp:1709294400")
+		writeTar(t, archive, tarFile("f", "tampered\n"))
+		if err := run(key.pub); err == nil || !strings.Contains(err.Error(), "invalid signature") {
+			t.Errorf("%s signature of a tampered archive: %v, want invalid signature", alg, err)
+		}
+
+		// Signed by another key
+		other := newMinisignKey(t, "otherkey")
+		other.sign(t, archive, alg, "timestamp:1709294400")
+		if err := run(key.pub); err == nil || !strings.Contains(err.Error(), "signed with key") {
+			t.Errorf("%s signature from another key: %v, want a key ID mismatch", alg, err)
+		}
+
+		// The same key ID, but not the same key
+		impostor := newMinisignKey(t, "xpldtest")
+		impostor.sign(t, archive, alg, "timestamp:1709294400")
+		if err := run(key.pub); err == nil || !strings.Contains(err.Error(), "invalid signature") {
+			t.Errorf("%s signature from a key with the same ID: %v, want invalid signature", alg, err)
+		}
+
+		// The trusted comment changed after it was signed
+		key.sign(t, archive, alg, "timestamp:1709294400")
+		sig, err := os.ReadFile(archive + ".minisig")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = []byte(strings.Replace(string(sig), "timestamp:1709294400", "timestamp:1893456000", 1))
+		if err := os.WriteFile(archive+".minisig", sig, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := run(key.pub); err == nil || !strings.Contains(err.Error(), "trusted comment") {
+			t.Errorf("%s signature with a tampered trusted comment: %v, want a trusted comment error", alg, err)
+		}
+	}
+
+	key.sign(t, archive, minisignAlgPrehashed, "timestamp:1709294400")
+	for _, cmd := range [][]string{{"extract", "-o", t.TempDir()}, {"inspect"}} {
+		_, err := runXpld(t, nil, append(append(cmd, "--verify-sig"), archive)...)
+		if err == nil || !strings.Contains(err.Error(), "--pubkey") {
+			t.Errorf("%s --verify-sig without --pubkey: %v, want an error asking for it", cmd[0], err)
+		}
+	}
+	if err := run("not a key"); err == nil {
+		t.Error("verification succeeded with a malformed public key")
+	}
+}
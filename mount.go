@@ -0,0 +1,283 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/mholt/archives"
+	"github.com/urfave/cli/v3"
+	"github.com/xplshn/xpld/pkg/xpld"
+)
+
+// mountArchive serves the archive as a read-only FUSE filesystem until it is
+// unmounted or xpld is interrupted. Directories are listed and files are read
+// from the archive on demand, so nothing is extracted up front.
+func mountArchive(ctx context.Context, c *cli.Command) error {
+	if c.Args().Len() != 2 {
+		return errors.New("usage: xpld mount <archive> <mountpoint>")
+	}
+	archive, mountpoint := c.Args().Get(0), c.Args().Get(1)
+	if err := verifySignature(c, archive); err != nil {
+		return err
+	}
+	fsys, err := archives.FileSystem(ctx, archive, nil)
+	if err != nil {
+		return err
+	}
+	// Reading the root indexes the whole archive once, so later lookups
+	// don't have to, and unreadable archives fail before anything is mounted
+	if _, err := fs.ReadDir(fsys, "."); err != nil {
+		return xpld.IdentifyError(archive, err)
+	}
+
+	root := &archiveNode{fsys: fsys, name: "."}
+	server, err := fusefs.Mount(mountpoint, root, &fusefs.Options{
+		MountOptions: fuse.MountOptions{
+			FsName:  archive,
+			Name:    "xpld",
+			Options: []string{"ro"},
+			// Lets root mount without fusermount installed
+			DirectMount: true,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("mounting %s: %w (is FUSE installed?)", mountpoint, err)
+	}
+	fmt.Fprintf(os.Stderr, "xpld: %s mounted on %s, press Ctrl-C to unmount\n", archive, mountpoint)
+
+	done := make(chan struct{})
+	go func() {
+		server.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	if err := server.Unmount(); err != nil {
+		return fmt.Errorf("unmounting %s: %w", mountpoint, err)
+	}
+	<-done
+	// An interrupt is the normal way to stop serving; only report timeouts
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return nil
+	}
+	return ctx.Err()
+}
+
+// archiveNode is a file, directory or symlink in a mounted archive. info is
+// nil for the root, which the archive has no entry for.
+type archiveNode struct {
+	fusefs.Inode
+	fsys fs.FS
+	name string
+	info fs.FileInfo
+}
+
+var (
+	_ fusefs.NodeLookuper   = (*archiveNode)(nil)
+	_ fusefs.NodeReaddirer  = (*archiveNode)(nil)
+	_ fusefs.NodeGetattrer  = (*archiveNode)(nil)
+	_ fusefs.NodeReadlinker = (*archiveNode)(nil)
+	_ fusefs.NodeOpener     = (*archiveNode)(nil)
+)
+
+func (n *archiveNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	child := path.Join(n.name, name)
+	info, err := statArchiveEntry(n.fsys, child)
+	if err != nil {
+		return nil, errno(err)
+	}
+	fillAttr(&out.Attr, info)
+	node := &archiveNode{fsys: n.fsys, name: child, info: info}
+	return n.NewInode(ctx, node, fusefs.StableAttr{Mode: fuseMode(info.Mode()) &^ 07777}), 0
+}
+
+func (n *archiveNode) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
+	entries, err := fs.ReadDir(n.fsys, n.name)
+	if err != nil {
+		return nil, errno(err)
+	}
+	list := make([]fuse.DirEntry, 0, len(entries))
+	for _, d := range entries {
+		list = append(list, fuse.DirEntry{Name: d.Name(), Mode: fuseMode(d.Type())})
+	}
+	return fusefs.NewListDirStream(list), 0
+}
+
+func (n *archiveNode) Getattr(ctx context.Context, fh fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if n.info == nil {
+		out.Mode = syscall.S_IFDIR | 0o555
+		return 0
+	}
+	fillAttr(&out.Attr, n.info)
+	return 0
+}
+
+func (n *archiveNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	if n.info == nil || n.info.Mode()&fs.ModeSymlink == 0 {
+		return nil, syscall.EINVAL
+	}
+	target := xpld.LinkTarget(n.info)
+	if target == "" {
+		return nil, syscall.EIO
+	}
+	return []byte(target), 0
+}
+
+func (n *archiveNode) Open(ctx context.Context, flags uint32) (fusefs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	f, err := n.fsys.Open(n.name)
+	if err != nil {
+		return nil, 0, errno(err)
+	}
+	return &archiveHandle{node: n, f: f}, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+// archiveHandle reads an open archive entry. Entries of compressed or
+// stream-only archives can't seek, so reads are served sequentially and the
+// entry is reopened if the kernel asks for an earlier offset.
+type archiveHandle struct {
+	node *archiveNode
+	mu   sync.Mutex
+	f    fs.File
+	off  int64
+}
+
+var (
+	_ fusefs.FileReader   = (*archiveHandle)(nil)
+	_ fusefs.FileReleaser = (*archiveHandle)(nil)
+)
+
+func (h *archiveHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ra, ok := h.f.(io.ReaderAt); ok {
+		n, err := ra.ReadAt(dest, off)
+		if err != nil && err != io.EOF {
+			return nil, errno(err)
+		}
+		return fuse.ReadResultData(dest[:n]), 0
+	}
+	if off != h.off {
+		if err := h.seek(off); err != nil {
+			return nil, errno(err)
+		}
+	}
+	n, err := io.ReadFull(h.f, dest)
+	h.off += int64(n)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, errno(err)
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+// seek moves the handle to off, reopening the entry to go backwards when it
+// can't seek.
+func (h *archiveHandle) seek(off int64) error {
+	if s, ok := h.f.(io.Seeker); ok {
+		if _, err := s.Seek(off, io.SeekStart); err != nil {
+			return err
+		}
+		h.off = off
+		return nil
+	}
+	if off < h.off {
+		f, err := h.node.fsys.Open(h.node.name)
+		if err != nil {
+			return err
+		}
+		h.f.Close()
+		h.f, h.off = f, 0
+	}
+	n, err := io.CopyN(io.Discard, h.f, off-h.off)
+	h.off += n
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+func (h *archiveHandle) Release(ctx context.Context) syscall.Errno {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return errno(h.f.Close())
+}
+
+func fillAttr(out *fuse.Attr, info fs.FileInfo) {
+	out.Mode = fuseMode(info.Mode())
+	out.Size = uint64(info.Size())
+	out.Nlink = 1
+	if info.IsDir() {
+		out.Size = 0
+	}
+	mtime := info.ModTime()
+	if mtime.IsZero() {
+		mtime = time.Unix(0, 0)
+	}
+	out.SetTimes(nil, &mtime, &mtime)
+	if uid, gid, _, _, ok := xpld.Owner(info); ok {
+		out.Uid, out.Gid = uint32(uid), uint32(gid)
+	}
+}
+
+// fuseMode converts a Go file mode to the stat(2) mode bits FUSE expects.
+func fuseMode(mode fs.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	switch {
+	case mode.IsDir():
+		bits |= syscall.S_IFDIR
+	case mode&fs.ModeSymlink != 0:
+		bits |= syscall.S_IFLNK
+	case mode&fs.ModeNamedPipe != 0:
+		bits |= syscall.S_IFIFO
+	case mode&fs.ModeSocket != 0:
+		bits |= syscall.S_IFSOCK
+	case mode&fs.ModeCharDevice != 0:
+		bits |= syscall.S_IFCHR
+	case mode&fs.ModeDevice != 0:
+		bits |= syscall.S_IFBLK
+	default:
+		bits |= syscall.S_IFREG
+	}
+	if mode&fs.ModeSetuid != 0 {
+		bits |= syscall.S_ISUID
+	}
+	if mode&fs.ModeSetgid != 0 {
+		bits |= syscall.S_ISGID
+	}
+	if mode&fs.ModeSticky != 0 {
+		bits |= syscall.S_ISVTX
+	}
+	return bits
+}
+
+// errno maps an error from the archive to the closest errno for the kernel.
+func errno(err error) syscall.Errno {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, fs.ErrNotExist):
+		return syscall.ENOENT
+	case errors.Is(err, fs.ErrPermission):
+		return syscall.EACCES
+	case errors.Is(err, fs.ErrInvalid):
+		return syscall.EINVAL
+	}
+	return syscall.EIO
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+
+	"github.com/urfave/cli/v3"
+)
+
+func mountArchive(ctx context.Context, c *cli.Command) error {
+	return fmt.Errorf("mount is not supported on %s, FUSE is only available on Linux and macOS", runtime.GOOS)
+}
@@ -0,0 +1,209 @@
+package xpld
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mholt/archives"
+)
+
+// OpenArchive opens the archive at path for reading: stdin for "-", all the
+// volumes of a split archive as one file, or else the file itself. It also
+// returns the name to tell the archive's format by. Closing stdin is left
+// to the process.
+func OpenArchive(path string) (io.ReadSeekCloser, string, error) {
+	if path == "-" {
+		return struct {
+			io.ReadSeeker
+			io.Closer
+		}{os.Stdin, io.NopCloser(nil)}, path, nil
+	}
+	if base, ok := splitVolumes(path); ok {
+		vols, err := openVolumes(base)
+		if err != nil {
+			return nil, "", err
+		}
+		return vols, base, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	return f, path, nil
+}
+
+// Identify identifies the format of f, the archive at path, or stdin when
+// path is "-". Stdin can't be rewound, so its format is sniffed from the
+// start of it, which is buffered, unless format names it by extension, such
+// as "tar.gz". Formats that need random access can't be read from a pipe.
+func Identify(ctx context.Context, path string, f io.ReadSeeker, format string) (archives.Format, io.Reader, error) {
+	if path != "-" {
+		format, input, err := archives.Identify(ctx, path, f)
+		if err != nil {
+			return nil, nil, IdentifyError(path, err)
+		}
+		return format, input, nil
+	}
+	name := ""
+	if format != "" {
+		name = "archive." + strings.TrimPrefix(format, ".")
+	}
+	// A pipe has to be hidden behind a plain reader, or Identify will try
+	// to seek in it instead of buffering what it reads
+	var r io.Reader = f
+	_, seekErr := f.Seek(0, io.SeekCurrent)
+	if seekErr != nil {
+		r = struct{ io.Reader }{f}
+	}
+	found, input, err := archives.Identify(ctx, name, r)
+	if errors.Is(err, archives.NoMatch) {
+		return nil, nil, errors.New("can't tell the format of the archive on stdin, use --format")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if seekErr != nil {
+		switch found.(type) {
+		case archives.Zip, archives.SevenZip:
+			return nil, nil, fmt.Errorf("%s archives can't be read from a pipe, save it to a file first", strings.TrimPrefix(found.Extension(), "."))
+		}
+	}
+	return found, input, nil
+}
+
+// formatHint points users at the list of formats xpld supports.
+const formatHint = "run `xpld list-formats` to see the supported formats"
+
+// IdentifyError explains an error from archives.Identify for the archive at
+// path, which is usually that its format wasn't recognized.
+func IdentifyError(path string, err error) error {
+	if !errors.Is(err, archives.NoMatch) {
+		return err
+	}
+	if ext := ArchiveExt(path); ext != "" {
+		return fmt.Errorf("can't tell the format of %s from its %s extension or its contents; %s", path, ext, formatHint)
+	}
+	return fmt.Errorf("can't tell the format of %s from its contents; %s", path, formatHint)
+}
+
+// ArchiveExtractor returns format's extractor, or an error naming the format
+// if it isn't an archive xpld can read, such as a compressed single file.
+func ArchiveExtractor(path string, format archives.Format) (archives.Extractor, error) {
+	var comp archives.Compression
+	switch f := format.(type) {
+	case archives.CompressedArchive:
+		if f.Extraction == nil {
+			comp = f.Compression
+		}
+	case archives.Compression:
+		comp = f
+	}
+	if comp != nil {
+		return nil, fmt.Errorf("%s is a %s-compressed file, not an archive; %s", path, strings.TrimPrefix(comp.Extension(), "."), formatHint)
+	}
+	extractor, ok := format.(archives.Extractor)
+	if !ok {
+		return nil, fmt.Errorf("%s is a %s archive, which xpld can't extract; %s", path, strings.TrimPrefix(format.Extension(), "."), formatHint)
+	}
+	return extractor, nil
+}
+
+// ArchiveExt returns the extension of path, including a .tar before it as
+// in .tar.gz.
+func ArchiveExt(path string) string {
+	ext := filepath.Ext(path)
+	if inner := filepath.Ext(strings.TrimSuffix(path, ext)); inner == ".tar" {
+		return inner + ext
+	}
+	return ext
+}
+
+// WithPassword sets the password that password returns on format, for the
+// formats mholt/archives can decrypt: 7z and rar. A nil password leaves
+// format as it is; for any other format it is an error, and password isn't
+// called.
+func WithPassword(format archives.Format, password func() (string, error)) (archives.Format, error) {
+	if password == nil {
+		return format, nil
+	}
+	switch format.(type) {
+	case archives.SevenZip, archives.Rar:
+	default:
+		return nil, fmt.Errorf("%s archives can't be decrypted, only 7z and rar archives take a password", strings.TrimPrefix(format.Extension(), "."))
+	}
+	pw, err := password()
+	if err != nil {
+		return nil, err
+	}
+	switch f := format.(type) {
+	case archives.SevenZip:
+		f.Password = pw
+		return f, nil
+	case archives.Rar:
+		f.Password = pw
+		return f, nil
+	}
+	return format, nil
+}
+
+// FileSystem opens the archive at path as an fs.FS, which stays usable
+// until the returned file is closed.
+func FileSystem(ctx context.Context, path string) (fs.FS, io.Closer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	format, _, err := archives.Identify(ctx, path, f)
+	if err != nil {
+		f.Close()
+		return nil, nil, IdentifyError(path, err)
+	}
+	if _, err := ArchiveExtractor(path, format); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	fsys, err := archives.FileSystem(ctx, path, f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return fsys, f, nil
+}
+
+// ReadEntries streams the contents of every regular file in the archive in a
+// single pass, calling fn with its cleaned path. Opening each file through
+// the archive's fs.FS instead would rescan stream-only formats like tar.gz
+// once per file.
+func ReadEntries(ctx context.Context, archive string, fn func(name string, info fs.FileInfo, r io.Reader) error) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	format, input, err := archives.Identify(ctx, archive, f)
+	if err != nil {
+		return IdentifyError(archive, err)
+	}
+	extractor, err := ArchiveExtractor(archive, format)
+	if err != nil {
+		return err
+	}
+	return extractor.Extract(ctx, input, func(ctx context.Context, fi archives.FileInfo) error {
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		r, err := fi.Open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return fn(filepath.Clean(fi.NameInArchive), fi.FileInfo, r)
+	})
+}
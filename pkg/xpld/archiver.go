@@ -0,0 +1,182 @@
+package xpld
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/zip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/mholt/archives"
+)
+
+// clampLevel limits level to the range lo-hi that the compressor for ext
+// supports, warning when it had to be changed.
+func clampLevel(level, lo, hi int, ext string, warn func(string)) int {
+	l := min(max(level, lo), hi)
+	if l != level && warn != nil {
+		warn(fmt.Sprintf("level %d out of range for %s (%d-%d), using %d", level, ext, lo, hi, l))
+	}
+	return l
+}
+
+// NewArchiver returns the archiver for format. Zip archives store files
+// whose extension says they're already compressed without deflating them
+// again if storeCompressed is set. A non-nil level sets the compression
+// level, clamped to the range the format's compressor supports with a
+// warning passed to warn.
+func NewArchiver(format archives.Format, level *int, storeCompressed bool, warn func(string)) (archives.Archiver, error) {
+	archiver, ok := format.(archives.Archiver)
+	if !ok {
+		return nil, fmt.Errorf("unsupported archive format")
+	}
+	if z, ok := format.(archives.Zip); ok {
+		z.Compression = zip.Deflate
+		z.SelectiveCompression = storeCompressed
+		archiver = z
+		if level != nil {
+			return levelZip{z, clampLevel(*level, 1, 9, z.Extension(), warn)}, nil
+		}
+	}
+	if level != nil {
+		ca, ok := format.(archives.CompressedArchive)
+		if !ok || ca.Compression == nil {
+			return nil, fmt.Errorf("%s archives are not compressed, --level does not apply", format.Extension())
+		}
+		comp, err := withLevel(ca.Compression, *level, warn)
+		if err != nil {
+			return nil, err
+		}
+		ca.Compression = comp
+		archiver = ca
+	}
+	return archiver, nil
+}
+
+// levelZip writes zip archives deflated at the given level. archives.Zip
+// always deflates at the default level, and deflate's compressor can only be
+// swapped out on the zip.Writer it creates internally, so the entries are
+// written here instead, the way archives.Zip writes them.
+type levelZip struct {
+	archives.Zip
+	level int
+}
+
+// storedExts are the extensions archives.Zip's SelectiveCompression stores
+// without deflating.
+var storedExts = map[string]bool{
+	".7z": true, ".avi": true, ".br": true, ".bz2": true, ".cab": true, ".docx": true, ".gif": true,
+	".gz": true, ".jar": true, ".jpeg": true, ".jpg": true, ".lz": true, ".lz4": true, ".lzma": true,
+	".m4v": true, ".mov": true, ".mp3": true, ".mp4": true, ".mpeg": true, ".mpg": true, ".png": true,
+	".pptx": true, ".rar": true, ".sz": true, ".tbz2": true, ".tgz": true, ".tsz": true, ".txz": true,
+	".xlsx": true, ".xz": true, ".zip": true, ".zipx": true,
+}
+
+func (z levelZip) writer(out io.Writer) *zip.Writer {
+	zw := zip.NewWriter(out)
+	zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, z.level)
+	})
+	return zw
+}
+
+func (z levelZip) Archive(ctx context.Context, out io.Writer, files []archives.FileInfo) error {
+	zw := z.writer(out)
+	for _, file := range files {
+		if err := z.write(ctx, zw, file); err != nil {
+			zw.Close()
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func (z levelZip) ArchiveAsync(ctx context.Context, out io.Writer, jobs <-chan archives.ArchiveAsyncJob) error {
+	zw := z.writer(out)
+	for job := range jobs {
+		job.Result <- z.write(ctx, zw, job.File)
+	}
+	return zw.Close()
+}
+
+func (z levelZip) write(ctx context.Context, zw *zip.Writer, file archives.FileInfo) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	hdr, err := zip.FileInfoHeader(file)
+	if err != nil {
+		return fmt.Errorf("getting info for file: %s: %w", file.NameInArchive, err)
+	}
+	hdr.Name = file.NameInArchive
+	switch {
+	case file.IsDir():
+		if !strings.HasSuffix(hdr.Name, "/") {
+			hdr.Name += "/"
+		}
+		hdr.Method = zip.Store
+	case z.SelectiveCompression && storedExts[strings.ToLower(path.Ext(hdr.Name))]:
+		hdr.Method = zip.Store
+	default:
+		hdr.Method = z.Compression
+	}
+	w, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return fmt.Errorf("creating header for file: %s: %w", file.NameInArchive, err)
+	}
+	switch {
+	case file.Mode()&fs.ModeSymlink != 0:
+		_, err = io.WriteString(w, file.LinkTarget)
+	case file.Mode().IsRegular():
+		var f fs.File
+		if f, err = file.Open(); err != nil {
+			break
+		}
+		_, err = io.CopyN(w, f, file.Size())
+		if err == io.EOF {
+			err = nil
+		}
+		f.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("writing file: %s: %w", file.NameInArchive, err)
+	}
+	return nil
+}
+
+// withLevel returns comp configured to compress at level. Levels outside the
+// range the compressor accepts are clamped, with a warning.
+func withLevel(comp archives.Compression, level int, warn func(string)) (archives.Compression, error) {
+	clamp := func(lo, hi int) int {
+		return clampLevel(level, lo, hi, comp.Extension(), warn)
+	}
+	switch cc := comp.(type) {
+	case archives.Gz:
+		cc.CompressionLevel = clamp(1, 9)
+		return cc, nil
+	case archives.Bz2:
+		cc.CompressionLevel = clamp(1, 9)
+		return cc, nil
+	case archives.Zlib:
+		cc.CompressionLevel = clamp(1, 9)
+		return cc, nil
+	case archives.Zstd:
+		cc.EncoderOptions = append(cc.EncoderOptions, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(clamp(1, 22))))
+		return cc, nil
+	case archives.Brotli:
+		cc.Quality = clamp(0, 11)
+		return cc, nil
+	case archives.Lz4:
+		// lz4 levels are powers of two, starting at 1<<9 for level 1
+		if l := clamp(0, 9); l > 0 {
+			cc.CompressionLevel = 1 << (8 + l)
+		} else {
+			cc.CompressionLevel = 0
+		}
+		return cc, nil
+	}
+	return nil, fmt.Errorf("%s compression does not support setting a level", comp.Extension())
+}
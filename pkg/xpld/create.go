@@ -0,0 +1,584 @@
+package xpld
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mholt/archives"
+)
+
+// CreateOptions are the settings for Create.
+type CreateOptions struct {
+	// Sources are the files and directories to archive. "-" and "@file"
+	// instead name a list of paths, read from stdin or file, that are
+	// archived exactly as listed rather than walked.
+	Sources []string
+	// Output is where the archive is written, or "-" for stdout.
+	Output string
+	// Format is the format to write; if nil, it's told from Output's name.
+	Format archives.Format
+	// Level is the compression level, or nil for the format's default.
+	Level *int
+	// StoreCompressed stores files in zip archives that are already
+	// compressed, going by their extension, without deflating them again.
+	StoreCompressed bool
+	// Split writes the archive as volumes of at most this many bytes each,
+	// Output.000, Output.001 and so on.
+	Split int64
+	// Comment is stored as the archive comment, which only zip supports.
+	Comment []byte
+	// KeepPartial leaves an archive that failed partway behind, rather than
+	// removing it.
+	KeepPartial bool
+
+	// Exclude are globs for paths to leave out, matched against the base
+	// name and against the path relative to its source.
+	Exclude []string
+	// Regex and IRegex select the entries whose names they match and don't
+	// match, respectively.
+	Regex, IRegex *regexp.Regexp
+	// Dereference archives what symlinks point to instead of the links.
+	Dereference bool
+	// TargetNames names the contents of a dereferenced link to a directory
+	// after the directory it points to, rather than after the link.
+	TargetNames bool
+	// NoRecursion stores directories inside a source without their
+	// contents.
+	NoRecursion bool
+
+	// FileMode and DirMode replace the permissions of files and
+	// directories, if set.
+	FileMode, DirMode *fs.FileMode
+	// Reproducible stores a fixed mtime, no owner and normalized
+	// permissions, and sorts the entries by name, so that the archive only
+	// depends on the names and contents of its entries.
+	Reproducible bool
+	// Mtime is stored as every entry's mtime when set, and as the fixed
+	// mtime with Reproducible, where it defaults to 1980-01-01.
+	Mtime time.Time
+	// ClampMtime only replaces mtimes later than Mtime, following the
+	// SOURCE_DATE_EPOCH spec.
+	ClampMtime bool
+	// Owner replaces the ownership tar archives record.
+	Owner *OwnerOverride
+
+	// DryRun returns the entries that would be archived without writing
+	// anything.
+	DryRun bool
+	// Open opens each file as it is archived; it defaults to os.Open.
+	Open func(name string) (*os.File, error)
+	// Log, if set, is called with each entry's name as it's added.
+	Log func(name string)
+	// Profile, if set, is called with how long each file took to archive.
+	Profile func(name string, size int64, elapsed time.Duration)
+	// Warn, if set, is called with problems that don't stop the archive
+	// from being written.
+	Warn func(msg string)
+}
+
+// OwnerOverride is the ownership Create records for every entry. Only the
+// user or group whose Set field is true is overridden.
+type OwnerOverride struct {
+	UID, GID          int
+	User, Group       string
+	SetUser, SetGroup bool
+}
+
+// Create archives each of opts.Sources into opts.Output and returns the
+// entries it stored. Entries are named relative to each source's parent
+// directory, so that "a/" is stored as "a/...", except for sources like "."
+// whose contents are stored at the root of the archive.
+func Create(ctx context.Context, opts CreateOptions) (entries []Entry, err error) {
+	srcs, dst := opts.Sources, opts.Output
+	if len(srcs) == 0 || dst == "" {
+		return nil, errors.New("source and output are required")
+	}
+	warn := func(format string, args ...any) {
+		if opts.Warn != nil {
+			opts.Warn(fmt.Sprintf(format, args...))
+		}
+	}
+	mtime := opts.Mtime
+	if opts.Reproducible && mtime.IsZero() {
+		// The earliest time every format can represent
+		mtime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	if opts.Split < 0 {
+		return nil, errors.New("split size must be positive")
+	}
+	if opts.Split > 0 {
+		if dst == "-" {
+			return nil, errors.New("--split can't be used when writing to stdout")
+		}
+		if opts.Comment != nil {
+			return nil, errors.New("--comment-file can't be used with --split")
+		}
+	}
+	format := opts.Format
+	if format == nil {
+		if format, _, err = archives.Identify(ctx, dst, nil); err != nil {
+			return nil, IdentifyError(dst, err)
+		}
+	}
+	archiver, err := NewArchiver(format, opts.Level, opts.StoreCompressed, opts.Warn)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Owner != nil && !isTarFormat(format) {
+		warn("%s archives don't record ownership, ignoring --owner and --group", strings.TrimPrefix(format.Extension(), "."))
+	}
+	if opts.Comment != nil {
+		if dst == "-" {
+			return nil, errors.New("--comment-file can't be used when writing to stdout")
+		}
+		if _, ok := format.(archives.Zip); !ok {
+			return nil, fmt.Errorf("%s archives can't hold a comment", format.Extension())
+		}
+		if len(opts.Comment) > 0xffff {
+			return nil, fmt.Errorf("comment is %d bytes, zip comments are limited to 65535", len(opts.Comment))
+		}
+	}
+	for _, pattern := range opts.Exclude {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %q: %w", pattern, err)
+		}
+	}
+	open := opts.Open
+	if open == nil {
+		open = os.Open
+	}
+
+	var inputs []archives.FileInfo
+	// A dereferenced link is only a loop if it leads to a directory the walk
+	// is already inside of, so each walk keeps its root and the link it last
+	// followed out of it; the directories between the two are the ancestors
+	// of whatever is being walked now. Directories are compared by identity
+	// (device and inode on Unix), so links to a directory archived elsewhere
+	// are still followed.
+	type walkFrame struct{ root, link string }
+	var frames []walkFrame
+	insideOf := func(info fs.FileInfo) bool {
+		for _, f := range frames {
+			for dir := f.link; dir != f.root && dir != filepath.Dir(dir); {
+				dir = filepath.Dir(dir)
+				if d, err := os.Stat(dir); err == nil && os.SameFile(d, info) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	seen := map[string]string{}
+	add := func(path, rel string, info fs.FileInfo) error {
+		switch {
+		case opts.Reproducible:
+			info = reproducibleFileInfo{info, mtime}
+		case !mtime.IsZero() && (!opts.ClampMtime || info.ModTime().After(mtime)):
+			info = mtimeFileInfo{info, mtime}
+		}
+		// Explicit permissions win over those Reproducible picks
+		switch {
+		case info.IsDir() && opts.DirMode != nil:
+			info = modeFileInfo{info, *opts.DirMode}
+		case info.Mode().IsRegular() && opts.FileMode != nil:
+			info = modeFileInfo{info, *opts.FileMode}
+		}
+		if opts.Owner != nil {
+			info = ownerFileInfo{info, opts.Owner}
+		}
+		if prev, ok := seen[rel]; ok {
+			return fmt.Errorf("both %s and %s would be stored as %s", prev, path, rel)
+		}
+		seen[rel] = path
+		// Links are stored as links, pointing where they do on disk
+		var target string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			var err error
+			if target, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		if opts.Log != nil {
+			opts.Log(rel)
+		}
+		inputs = append(inputs, archives.FileInfo{
+			NameInArchive: ArchiveName(rel, info),
+			FileInfo:      info,
+			LinkTarget:    target,
+			Open: func() (fs.File, error) {
+				if !info.Mode().IsRegular() {
+					return NoContent(info), nil
+				}
+				start := time.Now()
+				f, err := open(path)
+				if err != nil {
+					return nil, err
+				}
+				if opts.Profile == nil {
+					return ctxFile{f, ctx}, nil
+				}
+				return timedFile{ctxFile{f, ctx}, func() { opts.Profile(rel, info.Size(), time.Since(start)) }}, nil
+			},
+		})
+		return nil
+	}
+	var walk func(root, prefix string) error
+	walk = func(root, prefix string) error {
+		frames = append(frames, walkFrame{root: filepath.Clean(root)})
+		defer func() { frames = frames[:len(frames)-1] }()
+		return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			if rel != "." && excluded(opts.Exclude, rel) {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			// With NoRecursion, directories inside a source are stored
+			// without their contents
+			shallow := opts.NoRecursion && rel != "."
+			rel = filepath.Join(prefix, rel)
+			if opts.Regex != nil && !opts.Regex.MatchString(rel) {
+				return nil
+			}
+			if opts.IRegex != nil && opts.IRegex.MatchString(rel) {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if opts.Dereference && d.Type()&fs.ModeSymlink != 0 {
+				target, err := filepath.EvalSymlinks(path)
+				if err != nil {
+					return err
+				}
+				if target, err = filepath.Abs(target); err != nil {
+					return err
+				}
+				if info, err = os.Stat(target); err != nil {
+					return err
+				}
+				if info.IsDir() && !shallow {
+					frames[len(frames)-1].link = path
+					if insideOf(info) {
+						warn("not following %s, it leads back to a directory it is in", rel)
+						return nil
+					}
+					// The walk is rooted at the target, so its contents are named
+					// either after the link itself or after the directory it points to
+					if opts.TargetNames {
+						rel = filepath.Join(filepath.Dir(rel), filepath.Base(target))
+					}
+					return walk(target, rel)
+				}
+			}
+			if err := add(path, rel, info); err != nil {
+				return err
+			}
+			if shallow && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		})
+	}
+	for _, src := range srcs {
+		// "-" and "@file" name a list of exactly the paths to archive,
+		// which are added as they are rather than walked
+		if src == "-" || strings.HasPrefix(src, "@") {
+			paths, err := readFileList(src)
+			if err != nil {
+				return nil, err
+			}
+			for _, path := range paths {
+				stat := os.Lstat
+				if opts.Dereference {
+					stat = os.Stat
+				}
+				info, err := stat(path)
+				if err != nil {
+					return nil, err
+				}
+				if err := add(path, listedName(path), info); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		prefix := filepath.Base(filepath.Clean(src))
+		if prefix == "." || prefix == ".." || prefix == string(filepath.Separator) {
+			prefix = ""
+		}
+		if err := walk(src, prefix); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Reproducible {
+		sort.Slice(inputs, func(i, j int) bool { return inputs[i].NameInArchive < inputs[j].NameInArchive })
+	}
+	for _, in := range inputs {
+		entries = append(entries, Entry{Name: in.NameInArchive, Info: in.FileInfo})
+	}
+	if opts.DryRun {
+		return entries, nil
+	}
+	if _, ok := format.(archives.Zip); ok && (opts.Reproducible || !opts.Mtime.IsZero() && !opts.ClampMtime) && mtime.Year() < 1980 {
+		warn("zip can't store times before 1980, entries will get a wrong mtime")
+	}
+	outFile := os.Stdout
+	var out io.Writer = outFile
+	var volumes *splitWriter
+	switch {
+	case opts.Split > 0:
+		if volumes, err = newSplitWriter(dst, opts.Split); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil && !opts.KeepPartial {
+				volumes.remove()
+			}
+		}()
+		out = volumes
+	case dst != "-":
+		if outFile, err = os.Create(dst); err != nil {
+			return nil, err
+		}
+		defer outFile.Close()
+		// An archive that failed partway is truncated, so don't leave it
+		// behind to be mistaken for a good one
+		defer func() {
+			if err != nil && !opts.KeepPartial {
+				outFile.Close()
+				os.Remove(dst)
+			}
+		}()
+		out = outFile
+	}
+	if err := archiver.Archive(ctx, out, inputs); err != nil {
+		return nil, err
+	}
+	if volumes != nil {
+		if err := volumes.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Comment != nil {
+		if err := setZipComment(outFile, opts.Comment); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// setZipComment sets the comment of the freshly written zip file f, which
+// mholt/archives has no option for, by filling in the end of central
+// directory record it ends with.
+func setZipComment(f *os.File, comment []byte) error {
+	const eocdLen = 22
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	eocd := make([]byte, eocdLen)
+	if _, err := f.ReadAt(eocd, end-eocdLen); err != nil {
+		return err
+	}
+	if string(eocd[:4]) != "PK\x05\x06" {
+		return errors.New("zip end of central directory record not found")
+	}
+	if _, err := f.WriteAt([]byte{byte(len(comment)), byte(len(comment) >> 8)}, end-2); err != nil {
+		return err
+	}
+	_, err = f.Write(comment)
+	return err
+}
+
+// readFileList reads the paths listed in file (or stdin, for "-"), one per
+// line or separated by NULs as printed by `find -print0`.
+func readFileList(src string) ([]string, error) {
+	var data []byte
+	var err error
+	if src == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(strings.TrimPrefix(src, "@"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	sep := "\n"
+	if bytes.IndexByte(data, 0) >= 0 {
+		sep = "\x00"
+	}
+	var paths []string
+	for _, path := range strings.Split(string(data), sep) {
+		if path = strings.TrimSuffix(path, "\r"); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// listedName derives the name a listed path is stored under, dropping any
+// leading "/" and "../" so it can't be extracted outside the target.
+func listedName(path string) string {
+	name := filepath.ToSlash(filepath.Clean(path))
+	for {
+		trimmed := strings.TrimPrefix(strings.TrimPrefix(name, "/"), "../")
+		if trimmed == name {
+			break
+		}
+		name = trimmed
+	}
+	if name == ".." {
+		return "."
+	}
+	return name
+}
+
+// excluded reports whether rel, a path relative to the source being archived,
+// matches any of the exclude globs either by its base name or as a whole
+func excluded(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, filepath.Base(rel)); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isTarFormat reports whether format is a tarball, compressed or not.
+func isTarFormat(format archives.Format) bool {
+	switch f := format.(type) {
+	case archives.Tar:
+		return true
+	case archives.CompressedArchive:
+		_, ok := f.Archival.(archives.Tar)
+		return ok
+	}
+	return false
+}
+
+// timedFile calls done when closed, so the time an archiver spends reading
+// a file can be measured from when it was opened.
+type timedFile struct {
+	fs.File
+	done func()
+}
+
+func (f timedFile) Close() error {
+	f.done()
+	return f.File.Close()
+}
+
+// ctxReader fails reads once ctx is done, so that copying a large file can
+// be interrupted partway through.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// ctxFile is a file whose reads fail once ctx is done.
+type ctxFile struct {
+	fs.File
+	ctx context.Context
+}
+
+func (f ctxFile) Read(p []byte) (int, error) {
+	return ctxReader{f.ctx, f.File}.Read(p)
+}
+
+// modeFileInfo overrides the permission bits recorded for an entry,
+// clearing any setuid, setgid and sticky bits.
+type modeFileInfo struct {
+	fs.FileInfo
+	perm fs.FileMode
+}
+
+func (fi modeFileInfo) Mode() fs.FileMode {
+	return fi.FileInfo.Mode()&^(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky) | fi.perm
+}
+
+// reproducibleFileInfo normalizes what Create stores about a file for
+// Reproducible, so that the archive only depends on the names and contents
+// of its entries: a fixed mtime, no owner, and permissions of 0755 for
+// directories and executables and 0644 for everything else.
+type reproducibleFileInfo struct {
+	fs.FileInfo
+	mtime time.Time
+}
+
+func (fi reproducibleFileInfo) Mode() fs.FileMode {
+	m := fi.FileInfo.Mode()
+	perm := fs.FileMode(0o644)
+	switch {
+	case m&fs.ModeSymlink != 0:
+		perm = 0o777
+	case m.IsDir() || m&0o100 != 0:
+		perm = 0o755
+	}
+	return m&fs.ModeType | perm
+}
+
+func (fi reproducibleFileInfo) ModTime() time.Time { return fi.mtime }
+
+// Sys hides the file's stat, which tar would read the owner and access
+// times from.
+func (fi reproducibleFileInfo) Sys() any { return nil }
+
+// mtimeFileInfo overrides the mtime Create stores for a file.
+type mtimeFileInfo struct {
+	fs.FileInfo
+	mtime time.Time
+}
+
+func (fi mtimeFileInfo) ModTime() time.Time { return fi.mtime }
+
+// ownerFileInfo overrides the owner Create stores for a file. tar reads the
+// owner from Sys, so this hands it a header with the override applied on top
+// of whatever the file would otherwise have recorded.
+type ownerFileInfo struct {
+	fs.FileInfo
+	owner *OwnerOverride
+}
+
+func (fi ownerFileInfo) Sys() any {
+	hdr, err := tar.FileInfoHeader(fi.FileInfo, "")
+	if err != nil {
+		return fi.FileInfo.Sys()
+	}
+	if fi.owner.SetUser {
+		hdr.Uid, hdr.Uname = fi.owner.UID, fi.owner.User
+	}
+	if fi.owner.SetGroup {
+		hdr.Gid, hdr.Gname = fi.owner.GID, fi.owner.Group
+	}
+	return hdr
+}
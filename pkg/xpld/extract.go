@@ -0,0 +1,867 @@
+package xpld
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/mholt/archives"
+)
+
+// ExtractOptions are the settings for Extract.
+type ExtractOptions struct {
+	// Archive is the archive to extract: a file, the first volume of a
+	// split archive, or "-" for stdin.
+	Archive string
+	// Format names the format of an archive read from stdin by extension,
+	// such as "tar.gz", for when it can't be told from its contents.
+	Format string
+	// Password, if set, returns the password of a 7z or rar archive.
+	Password func() (string, error)
+	// Output is the directory to extract into.
+	Output string
+	// Filter selects the entries to extract.
+	Filter Filter
+
+	// Overwrite says what happens to files that already exist: "always"
+	// (the default) overwrites them, "never" keeps them and "newer" only
+	// overwrites those older than the entry.
+	Overwrite string
+	// Flatten extracts every file into Output itself, without the
+	// directories it is in.
+	Flatten bool
+	// OnCollision says what happens when Flatten gives two files the same
+	// name: "overwrite" (the default), "skip" or "rename".
+	OnCollision string
+	// NameTemplate, if set, names each extracted file, evaluated with its
+	// Name, Dir, Base, Stem, Ext and Index.
+	NameTemplate *template.Template
+	// Pipe, if set, is a shell command each file is piped to instead of
+	// being written, with {} replaced by its quoted name.
+	Pipe string
+
+	// AllowUnsafePaths extracts entries outside Output and creates symlinks
+	// pointing out of it.
+	AllowUnsafePaths bool
+	// NoSymlinks extracts symlinks as regular files.
+	NoSymlinks bool
+	// NoClobberSymlinks removes a symlink already at an entry's path rather
+	// than writing through it.
+	NoClobberSymlinks bool
+
+	// FileMode and DirMode replace the permissions of extracted files and
+	// directories, if set.
+	FileMode, DirMode *fs.FileMode
+	// PreservePermissions gives entries the permissions the archive stores.
+	PreservePermissions bool
+	// PreserveMtime restores the times the archive stores.
+	PreserveMtime bool
+	// RestoreOwnership gives files the ownership the archive stores, and
+	// RestoreUID includes the owning user, not just the group.
+	RestoreOwnership, RestoreUID bool
+	// IgnoreRootOwnership leaves files owned by root in the archive owned by
+	// whoever is extracting.
+	IgnoreRootOwnership bool
+	// StrictOwnership fails if ownership can't be restored, instead of
+	// carrying on without it.
+	StrictOwnership bool
+
+	// Dedup hardlinks files with the same content and mode to the first
+	// one extracted.
+	Dedup bool
+	// Jobs is how many zip entries to write at once.
+	Jobs int
+	// Unnest extracts archives found inside the archive in place of the
+	// files, up to MaxUnnest levels deep.
+	Unnest    bool
+	MaxUnnest int
+	// CleanupOnError removes what a failed extraction wrote.
+	CleanupOnError bool
+
+	// MaxSize, MaxFileSize and MaxFiles limit how much is extracted, in
+	// total, per file and in number of entries, if not 0. Reaching a limit
+	// stops the extraction with an error wrapping ErrLimit.
+	MaxSize, MaxFileSize int64
+	MaxFiles             int
+	// UnitBase is the base sizes are given in by messages, 1024 if 0.
+	UnitBase int64
+
+	// OnEntry, if set, is called with each entry's name as it starts being
+	// extracted.
+	OnEntry func(name string)
+	// Progress, if set, is written the bytes of each file as they're
+	// extracted.
+	Progress io.Writer
+	// Profile, if set, is called with how long each file took to extract.
+	Profile func(name string, size int64, elapsed time.Duration)
+	// Warn, if set, is called with entries skipped or renamed and other
+	// problems that don't stop the extraction.
+	Warn func(msg string)
+}
+
+// ExtractStats counts what Extract did beyond writing out the entries.
+type ExtractStats struct {
+	// Deduplicated is how many files Dedup hardlinked, saving DedupSaved
+	// bytes.
+	Deduplicated int
+	DedupSaved   int64
+	// Unowned is how many files ownership couldn't be restored for.
+	Unowned int
+}
+
+// Filter selects archive entries by name and type.
+type Filter struct {
+	// Pattern and IPattern are globs entries must and must not match,
+	// against their base name or, with FullPath, their whole path.
+	Pattern, IPattern string
+	FullPath          bool
+	// MatchDirs applies Pattern and IPattern to directories as well, and
+	// IPattern to everything in the directories it matches.
+	MatchDirs bool
+	// Regex and IRegex are expressions entry names must and must not
+	// match.
+	Regex, IRegex *regexp.Regexp
+	// OnlyRegular selects regular files alone.
+	OnlyRegular bool
+}
+
+// Match reports whether fi is selected. Directories that Pattern doesn't
+// select are kept but deferred, as they are only wanted if a matching file
+// is extracted beneath them.
+func (f Filter) Match(fi archives.FileInfo) (ok, deferred bool) {
+	name := fi.NameInArchive
+	if f.Regex != nil && !f.Regex.MatchString(name) {
+		return false, false
+	}
+	if f.IRegex != nil && f.IRegex.MatchString(name) {
+		return false, false
+	}
+	rel := filepath.Clean(name)
+	if f.IPattern != "" {
+		if (!fi.IsDir() || f.MatchDirs) && MatchPattern(f.IPattern, rel, f.FullPath) {
+			return false, false
+		}
+		// Entries arrive as a stream, so the contents of an excluded
+		// directory are recognized by their parents
+		if f.MatchDirs {
+			for dir := filepath.Dir(rel); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+				if MatchPattern(f.IPattern, dir, f.FullPath) {
+					return false, false
+				}
+			}
+		}
+	}
+	if f.Pattern != "" {
+		if fi.IsDir() {
+			deferred = !f.MatchDirs || !MatchPattern(f.Pattern, rel, f.FullPath)
+		} else if !MatchPattern(f.Pattern, rel, f.FullPath) {
+			return false, false
+		}
+	}
+	if f.OnlyRegular && !fi.Mode().IsRegular() {
+		return false, false
+	}
+	return true, deferred
+}
+
+// Extract extracts opts.Archive into opts.Output, and any archives in it
+// with opts.Unnest.
+func Extract(ctx context.Context, opts ExtractOptions) (ExtractStats, error) {
+	var stats ExtractStats
+	if opts.Archive == "" || opts.Output == "" && opts.Pipe == "" {
+		return stats, errors.New("archive path and output directory are required")
+	}
+	switch opts.Overwrite {
+	case "":
+		opts.Overwrite = "always"
+	case "always", "never", "newer":
+	default:
+		return stats, fmt.Errorf("invalid overwrite mode %q, must be always, never or newer", opts.Overwrite)
+	}
+	switch opts.OnCollision {
+	case "", "overwrite", "skip", "rename":
+	default:
+		return stats, fmt.Errorf("invalid collision policy %q, must be overwrite, skip or rename", opts.OnCollision)
+	}
+	if opts.UnitBase == 0 {
+		opts.UnitBase = 1024
+	}
+	x := &extraction{
+		opts:  opts,
+		quota: &extractQuota{maxSize: opts.MaxSize, maxFileSize: opts.MaxFileSize, maxFiles: opts.MaxFiles, base: opts.UnitBase},
+		stats: &stats,
+	}
+	err := x.extract(ctx, opts.Archive, opts.Output, 0)
+	return stats, err
+}
+
+// extraction is an Extract in progress, shared with the extractions of the
+// archives it unnests.
+type extraction struct {
+	opts  ExtractOptions
+	quota *extractQuota
+	stats *ExtractStats
+}
+
+func (x *extraction) warn(format string, args ...any) {
+	if x.opts.Warn != nil {
+		x.opts.Warn(fmt.Sprintf(format, args...))
+	}
+}
+
+// extract extracts tarball into dst. depth counts how many archives deep
+// tarball is nested, for Unnest.
+func (x *extraction) extract(ctx context.Context, tarball, dst string, depth int) error {
+	opts, quota := x.opts, x.quota
+	f, name, err := OpenArchive(tarball)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	format, input, err := Identify(ctx, name, f, opts.Format)
+	if err != nil {
+		return err
+	}
+	if depth == 0 {
+		if format, err = WithPassword(format, opts.Password); err != nil {
+			return err
+		}
+	}
+	extractor, err := ArchiveExtractor(tarball, format)
+	if err != nil {
+		return err
+	}
+
+	// The output directory with its own symlinks resolved, for checking
+	// where entries really end up
+	var realDst string
+	if dst != "" {
+		abs, err := filepath.Abs(dst)
+		if err != nil {
+			return err
+		}
+		if realDst, err = resolvePath("", abs); err != nil {
+			return err
+		}
+	}
+
+	var index int
+	// Dedup: first extracted path for each content digest and mode
+	dedup := map[string]string{}
+	// mu guards what file writes share, for when they run in parallel
+	var mu sync.Mutex
+	var pool *workerPool
+	extractCtx := ctx
+	if opts.Jobs > 1 {
+		// Only zip entries can be read independently of each other; other
+		// formats are a single stream that has to be read in order
+		if _, ok := format.(archives.Zip); ok {
+			pool, extractCtx = newWorkerPool(ctx, opts.Jobs)
+		} else {
+			x.warn("%s archives can only be extracted one file at a time, ignoring --jobs", strings.TrimPrefix(format.Extension(), "."))
+		}
+	}
+	var unnest []string
+	// With PreservePermissions or DirMode, directory modes are applied once
+	// everything else is written, so read-only directories can be filled
+	dirModes := map[string]fs.FileMode{}
+	// Likewise directory times, as writing into a directory updates its mtime
+	dirTimes := map[string]fs.FileInfo{}
+	// The archive entry each flattened name was taken by, for OnCollision
+	flattened := map[string]string{}
+	// What this extraction has created, to be removed with CleanupOnError
+	var written, created []string
+	mkdir := func(dir string) error {
+		if opts.CleanupOnError {
+			for d := dir; WithinDir(dst, d); d = filepath.Dir(d) {
+				if _, err := os.Lstat(d); !errors.Is(err, fs.ErrNotExist) {
+					break
+				}
+				created = append(created, d)
+			}
+		}
+		return os.MkdirAll(dir, 0755)
+	}
+	started := func(name string) {
+		if opts.OnEntry != nil {
+			opts.OnEntry(name)
+		}
+	}
+
+	err = extractor.Extract(extractCtx, input, func(ctx context.Context, fi archives.FileInfo) error {
+		name := fi.NameInArchive
+		ok, deferDir := opts.Filter.Match(fi)
+		if !ok {
+			return nil
+		}
+		if opts.Flatten {
+			name = filepath.Base(name)
+			if !fi.IsDir() {
+				if first, ok := flattened[name]; ok {
+					switch opts.OnCollision {
+					case "skip":
+						x.warn("skipping %s, %s was already extracted as %s", fi.NameInArchive, first, name)
+						return nil
+					case "rename":
+						ext := filepath.Ext(name)
+						renamed := name
+						for i := 1; flattened[renamed] != ""; i++ {
+							renamed = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), i, ext)
+						}
+						x.warn("extracting %s as %s, %s was already extracted as %s", fi.NameInArchive, renamed, first, name)
+						name = renamed
+					default:
+						x.warn("%s overwrites %s, both flatten to %s", fi.NameInArchive, first, name)
+					}
+				}
+				flattened[name] = fi.NameInArchive
+			}
+		}
+		if opts.NameTemplate != nil {
+			// Parent directories are created as needed for the renamed files
+			if fi.IsDir() {
+				return nil
+			}
+			ext := filepath.Ext(name)
+			var b strings.Builder
+			if err := opts.NameTemplate.Execute(&b, nameTemplateData{
+				Name:  name,
+				Dir:   filepath.Dir(name),
+				Base:  filepath.Base(name),
+				Stem:  strings.TrimSuffix(filepath.Base(name), ext),
+				Ext:   ext,
+				Index: index,
+			}); err != nil {
+				return err
+			}
+			index++
+			name = b.String()
+			if !WithinDir(dst, filepath.Join(dst, name)) {
+				return fmt.Errorf("name template produced %q, which is outside %s", name, dst)
+			}
+		}
+		if opts.Pipe != "" {
+			if !fi.Mode().IsRegular() {
+				return nil
+			}
+			started(fi.NameInArchive)
+			if err := quota.entry(); err != nil {
+				return err
+			}
+			return pipeEntry(ctx, opts.Pipe, name, fi, quota)
+		}
+		path := filepath.Join(dst, name)
+		isLink := fi.FileInfo.Mode()&fs.ModeSymlink != 0 && !opts.NoSymlinks
+		// Where the entry really goes, after any symlinks extracted before it
+		var real string
+		if !opts.AllowUnsafePaths {
+			if !WithinDir(dst, path) {
+				return fmt.Errorf("refusing to extract outside %s", dst)
+			}
+			// A link is replaced rather than followed, as is a symlink already
+			// at the entry's path under NoClobberSymlinks, so then only the
+			// directory it goes in has to stay inside
+			rel, err := filepath.Rel(dst, path)
+			if err != nil {
+				return err
+			}
+			if isLink || opts.NoClobberSymlinks {
+				rel = filepath.Dir(rel)
+			}
+			if real, err = resolvePath(realDst, rel); err != nil {
+				return err
+			}
+			if !WithinDir(realDst, real) {
+				return fmt.Errorf("refusing to extract %s, symlinks in its path lead outside %s", fi.NameInArchive, dst)
+			}
+		}
+		started(fi.NameInArchive)
+		if err := quota.entry(); err != nil {
+			return err
+		}
+		if opts.Overwrite != "always" && !fi.IsDir() {
+			if existing, err := os.Lstat(path); err == nil {
+				if opts.Overwrite == "never" {
+					x.warn("skipping %s, %s already exists", fi.NameInArchive, path)
+					return nil
+				}
+				if !fi.ModTime().After(existing.ModTime()) {
+					x.warn("skipping %s, %s is not older", fi.NameInArchive, path)
+					return nil
+				}
+			}
+		}
+		if opts.NoClobberSymlinks {
+			if err := removeSymlink(path); err != nil {
+				return err
+			}
+		}
+		if fi.IsDir() {
+			switch {
+			case opts.DirMode != nil:
+				dirModes[path] = *opts.DirMode
+			case opts.PreservePermissions:
+				dirModes[path] = fi.FileInfo.Mode()
+			}
+			if opts.PreserveMtime {
+				dirTimes[path] = fi.FileInfo
+			}
+			if deferDir {
+				return nil
+			}
+			return mkdir(path)
+		}
+		if err := mkdir(filepath.Dir(path)); err != nil {
+			return err
+		}
+		if isLink {
+			target := fi.LinkTarget
+			if !opts.AllowUnsafePaths {
+				to, err := resolvePath(real, target)
+				if err != nil {
+					return err
+				}
+				if filepath.IsAbs(target) || !WithinDir(realDst, to) {
+					return fmt.Errorf("refusing to create a symlink to %s, which is outside %s", target, dst)
+				}
+			}
+			if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			mu.Lock()
+			written = append(written, path)
+			mu.Unlock()
+			return os.Symlink(target, path)
+		}
+		// Files are written last, by a worker when extracting in parallel,
+		// once the directories they go in have been created
+		write := func() error {
+			start := time.Now()
+			r, err := fi.Open()
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			w, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+			defer w.Close()
+			mu.Lock()
+			written = append(written, path)
+			mu.Unlock()
+			var dw io.Writer = w
+			h := sha256.New()
+			if opts.Dedup {
+				dw = io.MultiWriter(w, h)
+			}
+			if opts.Progress != nil {
+				dw = io.MultiWriter(dw, opts.Progress)
+			}
+			if quota.limitsSize() {
+				dw = io.MultiWriter(&quotaWriter{quota: quota}, dw)
+			}
+			n, err := io.Copy(dw, ctxReader{ctx, r})
+			if errors.Is(err, ErrLimit) {
+				w.Close()
+				os.Remove(path)
+			}
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if opts.Profile != nil {
+				opts.Profile(fi.NameInArchive, n, time.Since(start))
+			}
+			if opts.Unnest && depth < opts.MaxUnnest {
+				unnest = append(unnest, path)
+			}
+			if opts.Dedup {
+				key := fmt.Sprintf("%x %v", h.Sum(nil), fi.FileInfo.Mode())
+				if first, ok := dedup[key]; ok {
+					// Link next to the copy and rename over it, so that if
+					// linking isn't possible (e.g. across devices) the copy stays
+					tmp := path + ".xpld-link"
+					if err := os.Link(first, tmp); err == nil {
+						if err := os.Rename(tmp, path); err != nil {
+							os.Remove(tmp)
+							return err
+						}
+						x.stats.Deduplicated++
+						x.stats.DedupSaved += n
+						return nil
+					}
+				} else {
+					dedup[key] = path
+				}
+			}
+			switch {
+			case opts.FileMode != nil:
+				if err := os.Chmod(path, *opts.FileMode); err != nil {
+					return err
+				}
+			case opts.PreservePermissions:
+				if err := os.Chmod(path, fi.FileInfo.Mode()); err != nil {
+					return err
+				}
+			}
+			if opts.RestoreOwnership {
+				if uid, gid, _, _, ok := Owner(fi.FileInfo); ok {
+					if !opts.RestoreUID {
+						uid = -1
+					}
+					// Root-owned entries are left to whoever is extracting
+					if opts.IgnoreRootOwnership {
+						if uid == 0 {
+							uid = -1
+						}
+						if gid == 0 {
+							gid = -1
+						}
+					}
+					if err := os.Chown(path, uid, gid); err != nil {
+						// Like tar, carry on without the ownership if it isn't
+						// ours to give away
+						if opts.StrictOwnership || !errors.Is(err, syscall.EPERM) && !errors.Is(err, syscall.ENOTSUP) {
+							return err
+						}
+						if x.stats.Unowned == 0 {
+							x.warn("can't restore ownership: %v", err)
+						}
+						x.stats.Unowned++
+					}
+				}
+			}
+			if opts.PreserveMtime {
+				return restoreTimes(path, fi.FileInfo)
+			}
+			return nil
+		}
+		if pool == nil {
+			return write()
+		}
+		return pool.do(func() error {
+			if err := write(); err != nil {
+				return fmt.Errorf("handling file: %s: %w", fi.NameInArchive, err)
+			}
+			return nil
+		})
+	})
+	if pool != nil {
+		if perr := pool.wait(); perr != nil {
+			err = perr
+		}
+	}
+	if err == nil {
+		err = x.unnest(ctx, unnest, depth)
+	}
+	if err != nil {
+		if opts.CleanupOnError {
+			removeExtracted(written, created)
+		}
+		return err
+	}
+	// Deepest first, as a parent without search permission would
+	// otherwise make its children unreachable
+	dirs := make([]string, 0, len(dirModes))
+	for dir := range dirModes {
+		dirs = append(dirs, dir)
+	}
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+	for _, dir := range dirs {
+		if err := os.Chmod(dir, dirModes[dir]); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	for dir, info := range dirTimes {
+		if err := restoreTimes(dir, info); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// unnest replaces each of the extracted files at paths that is itself an
+// archive with a directory holding its extracted contents, named after the
+// file without its archive extension.
+func (x *extraction) unnest(ctx context.Context, paths []string, depth int) error {
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		// Identify by content only, so files that merely have an archive
+		// extension are left alone
+		format, _, err := archives.Identify(ctx, "", f)
+		f.Close()
+		if errors.Is(err, archives.NoMatch) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, ok := format.(archives.Extractor); !ok {
+			continue
+		}
+		dir := strings.TrimSuffix(path, format.Extension())
+		if dir == path {
+			dir += ".d"
+		}
+		if err := x.extract(ctx, path, dir, depth+1); err != nil {
+			if errors.Is(err, ErrLimit) {
+				return err
+			}
+			x.warn("not unnesting %s: %v", path, err)
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nameTemplateData is what NameTemplate is evaluated against for each
+// extracted entry. Index counts the files extracted so far, starting at 0.
+type nameTemplateData struct {
+	Name, Dir, Base, Stem, Ext string
+	Index                      int
+}
+
+// restoreTimes sets the access and modification times of path to those
+// stored for it in the archive. Formats that don't store an access time get
+// the modification time for both, and entries without any time are left
+// alone.
+func restoreTimes(path string, info fs.FileInfo) error {
+	mtime := info.ModTime()
+	if mtime.IsZero() {
+		return nil
+	}
+	atime, ok := EntryTime(info, "atime")
+	if !ok {
+		atime = mtime
+	}
+	return os.Chtimes(path, atime, mtime)
+}
+
+// pipeEntry runs cmd through the shell with the contents of fi on its stdin.
+// Entry names come from the archive, so name is shell-quoted where it
+// replaces {} and is also passed in $XPLD_ENTRY.
+func pipeEntry(ctx context.Context, cmd, name string, fi archives.FileInfo, quota *extractQuota) error {
+	r, err := fi.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	quoted := "'" + strings.ReplaceAll(name, "'", `'\''`) + "'"
+	sh := exec.CommandContext(ctx, "sh", "-c", strings.ReplaceAll(cmd, "{}", quoted))
+	sh.Env = append(os.Environ(), "XPLD_ENTRY="+name)
+	sh.Stdin = r
+	// Piped data counts towards the size limits like written files do
+	qw := &quotaWriter{quota: quota}
+	if quota.limitsSize() {
+		sh.Stdin = io.TeeReader(r, qw)
+	}
+	sh.Stdout = os.Stdout
+	sh.Stderr = os.Stderr
+	err = sh.Run()
+	// The command may fail once its input is cut short, so the limit is
+	// reported rather than how the command took it
+	if qw.err != nil {
+		return qw.err
+	}
+	if err != nil {
+		return fmt.Errorf("pipe: %w", err)
+	}
+	return nil
+}
+
+// removeExtracted undoes a failed extraction for CleanupOnError, removing
+// the files and symlinks it wrote and then the directories it created, as far
+// as they are left empty. Errors are ignored, as this is already cleaning up
+// after one.
+func removeExtracted(files, dirs []string) {
+	for _, path := range files {
+		os.Remove(path)
+	}
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+	for _, dir := range dirs {
+		os.Remove(dir)
+	}
+}
+
+// resolvePath returns where the relative or absolute path rel leads from
+// dir, following symlinks one component at a time as the kernel would, so
+// that a ".." after a link goes up from where the link points. Components
+// that don't exist yet are taken as they are.
+func resolvePath(dir, rel string) (string, error) {
+	hops := 0
+	var resolve func(dir, rel string) (string, error)
+	resolve = func(dir, rel string) (string, error) {
+		if filepath.IsAbs(rel) {
+			dir = filepath.VolumeName(rel) + string(filepath.Separator)
+		}
+		for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+			switch part {
+			case "", ".":
+				continue
+			case "..":
+				dir = filepath.Dir(dir)
+				continue
+			}
+			next := filepath.Join(dir, part)
+			if info, err := os.Lstat(next); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+				if hops++; hops > 255 {
+					return "", fmt.Errorf("too many levels of symbolic links in %s", next)
+				}
+				target, err := os.Readlink(next)
+				if err != nil {
+					return "", err
+				}
+				if next, err = resolve(dir, target); err != nil {
+					return "", err
+				}
+			}
+			dir = next
+		}
+		return dir, nil
+	}
+	return resolve(dir, rel)
+}
+
+// removeSymlink removes path if it's a symlink, so that writing to it can't
+// be redirected to wherever it points.
+func removeSymlink(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// ErrLimit is wrapped by the errors Extract stops with when it reaches
+// MaxSize, MaxFileSize or MaxFiles.
+var ErrLimit = errors.New("extraction limit reached")
+
+// extractQuota enforces MaxSize, MaxFileSize and MaxFiles across the whole
+// extraction including any unnested archives, to guard against archives that
+// expand to fill the disk.
+type extractQuota struct {
+	mu          sync.Mutex
+	maxSize     int64
+	maxFileSize int64
+	maxFiles    int
+	base        int64
+	size        int64
+	files       int
+}
+
+// entry counts an entry about to be extracted against maxFiles.
+func (q *extractQuota) entry() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.files++
+	if q.maxFiles > 0 && q.files > q.maxFiles {
+		return fmt.Errorf("%w: more than %d entries (--max-files)", ErrLimit, q.maxFiles)
+	}
+	return nil
+}
+
+func (q *extractQuota) limitsSize() bool {
+	return q.maxSize > 0 || q.maxFileSize > 0
+}
+
+// quotaWriter counts the bytes of one extracted file against the quota,
+// failing as soon as a limit would be exceeded rather than once the file is
+// written.
+type quotaWriter struct {
+	quota *extractQuota
+	n     int64
+	// err is the limit that was reached, if any
+	err error
+}
+
+func (w *quotaWriter) Write(b []byte) (int, error) {
+	q := w.quota
+	w.n += int64(len(b))
+	if q.maxFileSize > 0 && w.n > q.maxFileSize {
+		w.err = fmt.Errorf("%w: file larger than %s (--max-file-size)", ErrLimit, FormatBytes(q.maxFileSize, q.base))
+		return 0, w.err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.size += int64(len(b))
+	if q.maxSize > 0 && q.size > q.maxSize {
+		w.err = fmt.Errorf("%w: files total more than %s (--max-size)", ErrLimit, FormatBytes(q.maxSize, q.base))
+		return 0, w.err
+	}
+	return len(b), nil
+}
+
+// workerPool runs file writes for Jobs on up to n goroutines at a time. The
+// first one to fail cancels the extraction, and its error is the one
+// reported.
+type workerPool struct {
+	sem    chan struct{}
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	err    error
+	cancel context.CancelFunc
+}
+
+func newWorkerPool(ctx context.Context, n int) (*workerPool, context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	return &workerPool{sem: make(chan struct{}, n), cancel: cancel}, ctx
+}
+
+// do runs job once a worker is free, or returns the error that stopped the
+// pool.
+func (p *workerPool) do(job func() error) error {
+	p.sem <- struct{}{}
+	if err := p.failed(); err != nil {
+		<-p.sem
+		return err
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer func() { <-p.sem }()
+		if err := job(); err != nil {
+			p.mu.Lock()
+			if p.err == nil {
+				p.err = err
+				p.cancel()
+			}
+			p.mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+func (p *workerPool) failed() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// wait waits for the running jobs to finish and returns the first error.
+func (p *workerPool) wait() error {
+	p.wg.Wait()
+	p.cancel()
+	return p.err
+}
@@ -0,0 +1,346 @@
+package xpld
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mholt/archives"
+)
+
+// InspectOptions are the settings for Inspect.
+type InspectOptions struct {
+	// Archive is the archive to list.
+	Archive string
+
+	// Pattern and IPattern are globs entries must and must not match,
+	// against their base name or, with FullPath, their whole path. Without
+	// MatchDirs they only apply to files, and Pattern leaves directories
+	// out of the listing.
+	Pattern, IPattern   string
+	FullPath, MatchDirs bool
+	// DirsOnly lists only directories.
+	DirsOnly bool
+	// SkipSpecial leaves out special files such as devices and fifos.
+	SkipSpecial bool
+	// Depth lists entries at most this many levels deep, if not 0.
+	Depth int
+	// MinSize and MaxSize, if set, limit the sizes of the files listed, and
+	// of directories too with MatchDirs.
+	MinSize, MaxSize *int64
+
+	// Recursive lists the contents of archives inside the archive as well,
+	// up to MaxRecursion levels deep, named "archive!entry".
+	Recursive    bool
+	MaxRecursion int
+	// ClassifyContent sets each file's Kind.
+	ClassifyContent bool
+	// Checksum, if set, names the algorithm for each file's Checksum: md5,
+	// sha1, sha256 or crc32.
+	Checksum string
+
+	// Each, if set, is called with each entry as it's found, instead of the
+	// entries being returned, so that huge archives can be listed without
+	// holding every entry in memory.
+	Each func(Entry) error
+	// Warn, if set, is called with nested archives that couldn't be listed.
+	Warn func(msg string)
+}
+
+// Entry is an archive entry as Inspect lists it.
+type Entry struct {
+	// Name is the entry's path in the archive, ending in "/" for
+	// directories.
+	Name string
+	Info fs.FileInfo
+	// Kind is "text" or "binary", with ClassifyContent.
+	Kind string
+	// Checksum is the hex digest of the file's contents, with Checksum.
+	Checksum string
+	// Nested is set for entries of an archive inside the archive.
+	Nested bool
+}
+
+// Inspect lists the entries of opts.Archive in the order they're found.
+func Inspect(ctx context.Context, opts InspectOptions) ([]Entry, error) {
+	if opts.Checksum != "" && NewChecksum(opts.Checksum) == nil {
+		return nil, fmt.Errorf("invalid checksum %q, must be md5, sha1, sha256 or crc32", opts.Checksum)
+	}
+	fsys, f, err := FileSystem(ctx, opts.Archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	match := func(pattern, path string) bool {
+		return MatchPattern(pattern, path, opts.FullPath)
+	}
+
+	kinds := map[string]string{}
+	if opts.ClassifyContent {
+		err := ReadEntries(ctx, opts.Archive, func(name string, _ fs.FileInfo, r io.Reader) error {
+			kind, err := ClassifyContent(r)
+			kinds[name] = kind
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sums := map[string]string{}
+	if opts.Checksum != "" {
+		err := ReadEntries(ctx, opts.Archive, func(name string, _ fs.FileInfo, r io.Reader) error {
+			if opts.Pattern != "" && !match(opts.Pattern, name) {
+				return nil
+			}
+			h := NewChecksum(opts.Checksum)
+			if _, err := io.Copy(h, r); err != nil {
+				return err
+			}
+			sums[name] = hex.EncodeToString(h.Sum(nil))
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var entries []Entry
+	emit := func(e Entry) error {
+		if opts.Each != nil {
+			return opts.Each(e)
+		}
+		entries = append(entries, e)
+		return nil
+	}
+	l := lister{opts: opts}
+	err = fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if opts.DirsOnly && !d.IsDir() {
+			return nil
+		}
+		// Without MatchDirs, patterns only select files and directories
+		// are left out of pattern-filtered listings. With Recursive, files
+		// that don't match are still searched in case they're archives.
+		nested := opts.Recursive && d.Type().IsRegular()
+		hidden := opts.Pattern != "" && (d.IsDir() && !opts.MatchDirs || !match(opts.Pattern, path))
+		if hidden && !nested {
+			return nil
+		}
+		if opts.IPattern != "" && (!d.IsDir() || opts.MatchDirs) && match(opts.IPattern, path) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		// Depth follows tree's DeepLevel: depth 1 lists only top-level
+		// entries, so a directory at the limit is listed but not entered.
+		depth := Depth(path)
+		if opts.Depth > 0 && depth > opts.Depth {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		descend := opts.Depth == 0 || depth < opts.Depth
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if opts.SkipSpecial && SpecialType(info.Mode()) != "" {
+			return nil
+		}
+		if !l.inSizeRange(info) {
+			if hidden = true; !nested {
+				return nil
+			}
+		}
+		name := path
+		if d.IsDir() && !strings.HasSuffix(name, "/") {
+			name += "/"
+		}
+		if !hidden {
+			if err := emit(Entry{Name: name, Info: info, Kind: kinds[path], Checksum: sums[path]}); err != nil {
+				return err
+			}
+		}
+		if nested {
+			r, err := fsys.Open(path)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			return l.listNested(ctx, name, r, 1, emit)
+		}
+		if d.IsDir() && !descend {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// lister applies Inspect's options to the entries of nested archives.
+type lister struct {
+	opts InspectOptions
+}
+
+// listNested lists the contents of r, the archive entry called name, if it
+// is itself an archive, passing fn each entry named "name!entry". Archives
+// found inside are listed in turn, up to MaxRecursion levels deep. Entries
+// are identified by content, so files that merely have an archive extension
+// are listed as plain files, and inner archives that can't be read are
+// reported and skipped.
+func (l lister) listNested(ctx context.Context, name string, r io.Reader, level int, fn func(Entry) error) error {
+	if level > l.opts.MaxRecursion {
+		return nil
+	}
+	format, input, err := archives.Identify(ctx, "", r)
+	if errors.Is(err, archives.NoMatch) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	extractor, ok := format.(archives.Extractor)
+	if ca, compressed := format.(archives.CompressedArchive); !ok || compressed && ca.Extraction == nil {
+		return nil
+	}
+	// Zip needs random access, which an entry being read doesn't have
+	tmp, err := os.CreateTemp("", "xpld-nested-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if _, err := io.Copy(tmp, input); err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	err = extractor.Extract(ctx, tmp, func(ctx context.Context, fi archives.FileInfo) error {
+		path := strings.TrimPrefix(filepath.Clean(fi.NameInArchive), "/")
+		e := Entry{Name: name + "!" + path, Info: fi.FileInfo, Nested: true}
+		if fi.IsDir() {
+			e.Name += "/"
+		}
+		if l.listed(e) {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		if !fi.Mode().IsRegular() || l.opts.IPattern != "" && MatchPattern(l.opts.IPattern, path, l.opts.FullPath) {
+			return nil
+		}
+		r, err := fi.Open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return l.listNested(ctx, e.Name, r, level+1, fn)
+	})
+	if err != nil && ctx.Err() == nil {
+		if l.opts.Warn != nil {
+			l.opts.Warn(fmt.Sprintf("not listing %s: %v", name, err))
+		}
+		return nil
+	}
+	return err
+}
+
+// listed applies Inspect's filters to e, an entry of a nested archive.
+func (l lister) listed(e Entry) bool {
+	opts := l.opts
+	dir := e.Info.IsDir()
+	path := strings.TrimSuffix(e.Name, "/")
+	if opts.DirsOnly && !dir {
+		return false
+	}
+	if opts.Pattern != "" && (dir && !opts.MatchDirs || !MatchPattern(opts.Pattern, path, opts.FullPath)) {
+		return false
+	}
+	if opts.IPattern != "" && (!dir || opts.MatchDirs) && MatchPattern(opts.IPattern, path, opts.FullPath) {
+		return false
+	}
+	if !l.inSizeRange(e.Info) {
+		return false
+	}
+	return !opts.SkipSpecial || SpecialType(e.Info.Mode()) == ""
+}
+
+// inSizeRange reports whether info is within MinSize and MaxSize.
+// Directories always are, unless MatchDirs applies the limits to them.
+func (l lister) inSizeRange(info fs.FileInfo) bool {
+	if info.IsDir() && !l.opts.MatchDirs {
+		return true
+	}
+	if n := l.opts.MinSize; n != nil && info.Size() < *n {
+		return false
+	}
+	if n := l.opts.MaxSize; n != nil && info.Size() > *n {
+		return false
+	}
+	return true
+}
+
+// NewChecksum returns a hash for the checksum algorithm named algo, or nil
+// if there is no such algorithm.
+func NewChecksum(algo string) hash.Hash {
+	switch algo {
+	case "md5":
+		return md5.New()
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	case "crc32":
+		return crc32.NewIEEE()
+	}
+	return nil
+}
+
+// ClassifyContent labels r as "text" or "binary" from its first few KB: any
+// NUL byte or invalid UTF-8 makes it binary.
+func ClassifyContent(r io.Reader) (string, error) {
+	buf := make([]byte, 8000)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	full := n == len(buf)
+	buf = buf[:n]
+	if bytes.IndexByte(buf, 0) >= 0 {
+		return "binary", nil
+	}
+	// The sniff buffer may cut a multi-byte rune in half
+	for i := len(buf) - 1; full && i >= 0 && i >= len(buf)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(buf[i]) {
+			if !utf8.FullRune(buf[i:]) {
+				buf = buf[:i]
+			}
+			break
+		}
+	}
+	if !utf8.Valid(buf) {
+		return "binary", nil
+	}
+	return "text", nil
+}
@@ -0,0 +1,234 @@
+package xpld
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// volumeName returns the name of the i-th volume of a split archive.
+func volumeName(base string, i int) string {
+	return fmt.Sprintf("%s.%03d", base, i)
+}
+
+// splitWriter writes an archive as numbered volumes of at most size bytes
+// each, base.000, base.001 and so on. This is a plain split of the archive's
+// bytes, not a format's own multi-volume support, so the volumes have to be
+// joined back together to be read.
+type splitWriter struct {
+	base    string
+	size    int64
+	f       *os.File
+	n       int64
+	volumes []string
+}
+
+func newSplitWriter(base string, size int64) (*splitWriter, error) {
+	if size <= 0 {
+		return nil, errors.New("split size must be positive")
+	}
+	w := &splitWriter{base: base, size: size}
+	if err := w.next(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// next closes the current volume, if any, and starts the next one.
+func (w *splitWriter) next() error {
+	if w.f != nil {
+		if err := w.f.Close(); err != nil {
+			return err
+		}
+	}
+	name := volumeName(w.base, len(w.volumes))
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w.f, w.n = f, 0
+	w.volumes = append(w.volumes, name)
+	return nil
+}
+
+func (w *splitWriter) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		// A new volume is only started once there is more to write, so the
+		// last one is never empty
+		if w.n == w.size {
+			if err := w.next(); err != nil {
+				return written, err
+			}
+		}
+		chunk := b
+		if room := w.size - w.n; int64(len(chunk)) > room {
+			chunk = chunk[:room]
+		}
+		n, err := w.f.Write(chunk)
+		written += n
+		w.n += int64(n)
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Close closes the last volume and removes any volumes following it that an
+// earlier, larger archive of the same name left behind, which would
+// otherwise be joined onto this one when it is read.
+func (w *splitWriter) Close() error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	for i := len(w.volumes); ; i++ {
+		if err := os.Remove(volumeName(w.base, i)); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// remove deletes every volume written so far.
+func (w *splitWriter) remove() {
+	w.f.Close()
+	for _, name := range w.volumes {
+		os.Remove(name)
+	}
+}
+
+// splitVolumes reports whether path names a split archive, either by its
+// first volume (name.000) or by the name the volumes share when no file of
+// that name exists, and returns that name.
+func splitVolumes(path string) (base string, ok bool) {
+	if strings.HasSuffix(path, ".000") {
+		return strings.TrimSuffix(path, ".000"), true
+	}
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		return "", false
+	}
+	if _, err := os.Stat(volumeName(path, 0)); err != nil {
+		return "", false
+	}
+	return path, true
+}
+
+// volumeReader reads the volumes of a split archive as one file. It can seek
+// and read at any offset, so formats that need random access, like zip, can
+// be read from volumes too.
+type volumeReader struct {
+	files []*os.File
+	// ends holds the offset each volume ends at within the whole archive
+	ends []int64
+	off  int64
+}
+
+// openVolumes opens base.000, base.001 and so on up to the first one that
+// doesn't exist.
+func openVolumes(base string) (*volumeReader, error) {
+	r := &volumeReader{}
+	var end int64
+	for i := 0; ; i++ {
+		f, err := os.Open(volumeName(base, i))
+		if errors.Is(err, fs.ErrNotExist) && i > 0 {
+			return r, nil
+		}
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			r.Close()
+			return nil, err
+		}
+		end += info.Size()
+		r.files = append(r.files, f)
+		r.ends = append(r.ends, end)
+	}
+}
+
+func (r *volumeReader) size() int64 {
+	return r.ends[len(r.ends)-1]
+}
+
+func (r *volumeReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	var n int
+	for i, end := range r.ends {
+		if len(p) == 0 {
+			return n, nil
+		}
+		if off >= end {
+			continue
+		}
+		var start int64
+		if i > 0 {
+			start = r.ends[i-1]
+		}
+		chunk := p
+		if room := end - off; int64(len(chunk)) > room {
+			chunk = chunk[:room]
+		}
+		m, err := r.files[i].ReadAt(chunk, off-start)
+		n += m
+		off += int64(m)
+		p = p[m:]
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if m < len(chunk) {
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *volumeReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.off)
+	r.off += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *volumeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size()
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+func (r *volumeReader) Close() error {
+	var err error
+	for _, f := range r.files {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
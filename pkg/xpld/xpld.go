@@ -0,0 +1,191 @@
+// Package xpld creates, extracts and inspects archives with
+// github.com/mholt/archives; it is what the xpld command is built on. Create,
+// Extract and Inspect take their settings in CreateOptions, ExtractOptions
+// and InspectOptions, and the helpers alongside them read owners, link
+// targets and times from the FileInfos mholt/archives returns, name
+// entries, and keep extracted paths inside their target.
+package xpld
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mholt/archives"
+)
+
+// Owner returns the ownership recorded in the archive for info, if the
+// format stores any. user and group are empty when only IDs are known.
+func Owner(info fs.FileInfo) (uid, gid int, user, group string, ok bool) {
+	switch sys := info.Sys().(type) {
+	case *tar.Header:
+		return sys.Uid, sys.Gid, sys.Uname, sys.Gname, true
+	case interface {
+		Uid() int
+		Gid() int
+	}:
+		return sys.Uid(), sys.Gid(), "", "", true
+	}
+	return 0, 0, "", "", false
+}
+
+// LinkTarget returns the link target stored in the archive for info, or ""
+// if the format doesn't record one.
+func LinkTarget(info fs.FileInfo) string {
+	if fi, ok := info.(archives.FileInfo); ok {
+		return fi.LinkTarget
+	}
+	return ""
+}
+
+// NoContent returns an empty, already open file for the directory or link
+// described by info, for archives.FileInfo.Open to hand to archivers, which
+// read nothing from it but may still Stat and Close it.
+func NoContent(info fs.FileInfo) fs.File {
+	return noContent{info}
+}
+
+type noContent struct{ info fs.FileInfo }
+
+func (f noContent) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f noContent) Read([]byte) (int, error)   { return 0, io.EOF }
+func (f noContent) Close() error               { return nil }
+
+// ArchiveName returns the name to store the entry called name under, which
+// for directories ends in "/" as tar and zip expect.
+func ArchiveName(name string, info fs.FileInfo) string {
+	if info.IsDir() && !strings.HasSuffix(name, "/") {
+		return name + "/"
+	}
+	return name
+}
+
+// WithinDir reports whether path is dir itself or lies beneath it.
+func WithinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Depth reports how deep the slash-separated path sits below the archive
+// root: "." is 0 and top-level entries are 1.
+func Depth(path string) int {
+	if path == "." {
+		return 0
+	}
+	return strings.Count(path, "/") + 1
+}
+
+// MatchPattern reports whether the glob pattern matches the entry at path,
+// which is matched against its base name, or its full path within the
+// archive if fullPath is set.
+func MatchPattern(pattern, path string, fullPath bool) bool {
+	if !fullPath {
+		path = filepath.Base(path)
+	}
+	ok, _ := filepath.Match(pattern, path)
+	return ok
+}
+
+// SpecialType names the kind of special file m describes, or returns "" for
+// regular files, directories and symlinks, whose sizes and contents mean
+// what they say.
+func SpecialType(m fs.FileMode) string {
+	switch {
+	case m&fs.ModeNamedPipe != 0:
+		return "fifo"
+	case m&fs.ModeSocket != 0:
+		return "socket"
+	case m&fs.ModeCharDevice != 0:
+		return "char device"
+	case m&fs.ModeDevice != 0:
+		return "block device"
+	case m&fs.ModeIrregular != 0:
+		return "irregular"
+	}
+	return ""
+}
+
+// EntryTime returns the mtime, ctime or atime recorded for info, if the
+// archive format stores it.
+func EntryTime(info fs.FileInfo, field string) (time.Time, bool) {
+	if field == "mtime" {
+		return info.ModTime(), true
+	}
+	if hdr, ok := info.Sys().(*tar.Header); ok {
+		t := hdr.AccessTime
+		if field == "ctime" {
+			t = hdr.ChangeTime
+		}
+		return t, !t.IsZero()
+	}
+	switch field {
+	case "ctime":
+		if stat, ok := info.Sys().(interface{ Ctime() time.Time }); ok {
+			return stat.Ctime(), true
+		}
+	case "atime":
+		if stat, ok := info.Sys().(interface{ Atime() time.Time }); ok {
+			return stat.Atime(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// ParseBytes parses a size such as 512, 4K or 1.5G in units of base, the
+// same way FormatBytes prints them. An explicit binary suffix such as KiB
+// is always in units of 1024.
+func ParseBytes(s string, base int64) (int64, error) {
+	num := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	if strings.HasSuffix(num, "I") {
+		num, base = strings.TrimSuffix(num, "I"), 1024
+	}
+	unit := int64(1)
+	if num != "" {
+		if i := strings.IndexByte("KMGTPE", num[len(num)-1]); i >= 0 {
+			for ; i >= 0; i-- {
+				unit *= base
+			}
+			num = num[:len(num)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a size", s)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// FormatBytes prints i in units of base: K, M, G, ... for 1024, or KB, MB,
+// GB, ... for 1000.
+func FormatBytes(i, base int64) string {
+	const units = "KMGTPE"
+	n, u := float64(i), -1
+	for u+1 < len(units) && n >= float64(base) {
+		n /= float64(base)
+		u++
+	}
+	if u < 0 {
+		return fmt.Sprintf("%.0f", n)
+	}
+	// Rounding can carry into the next unit, as 1048575 would print as
+	// 1024K, so move up before it does
+	if math.Round(n) >= float64(base) && u+1 < len(units) {
+		n /= float64(base)
+		u++
+	}
+	sFmt := "%.0f"
+	if math.Round(n*10) < 100 {
+		sFmt = "%.01f"
+	}
+	eFmt := units[u : u+1]
+	if base == 1000 {
+		eFmt += "B"
+	}
+	return fmt.Sprintf(sFmt, n) + eFmt
+}
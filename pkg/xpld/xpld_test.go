@@ -0,0 +1,57 @@
+package xpld
+
+import "testing"
+
+func TestFormatBytes(t *testing.T) {
+	for _, tt := range []struct {
+		n    int64
+		base int64
+		want string
+	}{
+		{0, 1024, "0"},
+		{1023, 1024, "1023"},
+		{1024, 1024, "1.0K"},
+		{1536, 1024, "1.5K"},
+		{10239, 1024, "10K"},
+		{10240, 1024, "10K"},
+		{1048575, 1024, "1.0M"},
+		{1048576, 1024, "1.0M"},
+		{999, 1000, "999"},
+		{1000, 1000, "1.0KB"},
+		{9999, 1000, "10KB"},
+		{999999, 1000, "1.0MB"},
+		{1500000, 1000, "1.5MB"},
+	} {
+		if got := FormatBytes(tt.n, tt.base); got != tt.want {
+			t.Errorf("FormatBytes(%d, %d) = %q, want %q", tt.n, tt.base, got, tt.want)
+		}
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		base int64
+		want int64
+	}{
+		{"512", 1024, 512},
+		{"4K", 1024, 4096},
+		{"4K", 1000, 4000},
+		{"4kb", 1000, 4000},
+		// A binary suffix is in units of 1024 whatever the base
+		{"4KiB", 1000, 4096},
+		{"1.5G", 1000, 1500000000},
+		{"1.5G", 1024, 1610612736},
+		{"1.0MB", 1000, 1000000},
+	} {
+		got, err := ParseBytes(tt.s, tt.base)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseBytes(%q, %d) = %d, %v; want %d", tt.s, tt.base, got, err, tt.want)
+		}
+	}
+	for _, s := range []string{"", "K", "-1", "4X", "1.5.2M"} {
+		if n, err := ParseBytes(s, 1024); err == nil {
+			t.Errorf("ParseBytes(%q) = %d, want an error", s, n)
+		}
+	}
+}
@@ -4,45 +4,194 @@
 package main
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"cmp"
 	"context"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/fs"
 	"os"
+	"os/exec"
+	"os/signal"
+	osuser "os/user"
+	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
 	"strings"
 	"strconv"
+	"sync"
+	"syscall"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 	"net/mail"
 
 	"github.com/a8m/tree"
+	"github.com/klauspost/compress/zip"
 	"github.com/mholt/archives"
 	"github.com/urfave/cli/v3"
+	"github.com/xplshn/xpld/pkg/xpld"
 )
 
 func main() {
-	app := &cli.Command{
+	// Cancelling the context stops archiving and extraction at the next
+	// read; a second signal kills xpld outright
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	cancelTimeout := context.CancelFunc(func() {})
+	app := newApp(&cancelTimeout)
+	err := app.Run(ctx, stdinArgs(app, os.Args))
+	cancelTimeout()
+	stop()
+	if err != nil {
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			err = fmt.Errorf("timed out: %w", err)
+		case errors.Is(err, context.Canceled):
+			err = fmt.Errorf("interrupted: %w", err)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// stdinArgs rearranges args so that flags can follow a "-" naming stdin.
+// The cli package stops parsing at a lone "-" and drops everything after it,
+// so when one is given, the command's flags are moved before a "--" and its
+// arguments after it, in the order they were given. A "-" that is a flag's
+// value, as in -o -, stays with the flag.
+func stdinArgs(app *cli.Command, args []string) []string {
+	if len(args) == 0 {
+		return args
+	}
+	lineage := []*cli.Command{app}
+	// takesValue reports whether the flag named name, of the command being
+	// parsed or one of its parents, is followed by a value
+	takesValue := func(name string) bool {
+		for _, cmd := range lineage {
+			for _, f := range cmd.Flags {
+				if slices.Contains(f.Names(), name) {
+					_, isBool := f.(*cli.BoolFlag)
+					return !isBool
+				}
+			}
+		}
+		return false
+	}
+	head := []string{args[0]}
+	var flags, positional []string
+	stdin := false
+loop:
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			positional = append(positional, args[i+1:]...)
+			break loop
+		case arg == "-":
+			stdin = true
+			positional = append(positional, arg)
+		case strings.HasPrefix(arg, "-"):
+			flags = append(flags, arg)
+			name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+			if !hasValue && takesValue(name) && i+1 < len(args) {
+				i++
+				flags = append(flags, args[i])
+			}
+		case lineage[len(lineage)-1].Command(arg) != nil:
+			// What came before the subcommand belongs to its parents
+			head = append(append(head, flags...), arg)
+			flags = nil
+			lineage = append([]*cli.Command{lineage[len(lineage)-1].Command(arg)}, lineage...)
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	if !stdin {
+		return args
+	}
+	return append(append(append(head, flags...), "--"), positional...)
+}
+
+// newApp builds the xpld command. Its Before hook points cancelTimeout at
+// the function releasing --timeout's timer, for the caller to run once the
+// command is done.
+func newApp(cancelTimeout *context.CancelFunc) *cli.Command {
+	return &cli.Command{
 		Name:  "xpld",
 		Authors: []any{
 			&mail.Address{Name: "xplshn", Address: "anto@xplshn.com.ar"},
 		},
 		Version: "v1",
 		Usage: "compress, extract, or inspect archive files",
+		EnableShellCompletion: true,
+		Flags: []cli.Flag{
+			&cli.DurationFlag{Name: "timeout", Usage: "give up on the command after this long, e.g. 10m"},
+			&cli.BoolFlag{Name: "force-tty", Usage: "behave as if attached to a terminal"},
+			&cli.BoolFlag{Name: "no-tty", Usage: "behave as if not attached to a terminal"},
+			&cli.IntFlag{Name: "unit-base", Value: 1024, Usage: "print and parse sizes in units of 1000 (KB, MB) or 1024 (K, M)",
+				Validator: func(base int) error {
+					if base != 1000 && base != 1024 {
+						return fmt.Errorf("unit base must be 1000 or 1024, not %d", base)
+					}
+					return nil
+				}},
+		},
+		Before: func(ctx context.Context, c *cli.Command) (context.Context, error) {
+			if d := c.Duration("timeout"); d > 0 {
+				ctx, *cancelTimeout = context.WithTimeout(ctx, d)
+			}
+			return ctx, nil
+		},
 		Commands: []*cli.Command{
 			{
 				Name:      "create",
 				Aliases:   []string{"c"},
 				Usage:     "create an archive from files or directories",
-				ArgsUsage: "<source>",
+				ArgsUsage: "<source>...",
 				Flags: append(commonFlags(&cli.StringFlag{Name: "output", Aliases: []string{"o"}, Required: true}),
 					&cli.StringFlag{Name: "regex", Usage: "include only paths matching this regex"},
-					&cli.StringFlag{Name: "iregex", Usage: "exclude paths matching this regex"}),
+					&cli.StringFlag{Name: "iregex", Usage: "exclude paths matching this regex"},
+					&cli.BoolFlag{Name: "dereference", Aliases: []string{"H"}, Usage: "follow symlinks and archive what they point to, instead of storing the links"},
+					&cli.StringFlag{Name: "owner", Usage: "record this user as every entry's owner: name, uid or name:uid"},
+					&cli.StringFlag{Name: "group", Usage: "record this group as every entry's group: name, gid or name:gid"},
+					&cli.BoolFlag{Name: "no-recursion", Usage: "only archive the entries directly inside each source directory, not their contents"},
+					&cli.StringFlag{Name: "link-name-mode", Usage: "name dereferenced directories after the: link|target", Value: "link"},
+					&cli.StringFlag{Name: "capture-mode", Usage: "permissions to store for files and directories: disk|default", Value: "disk"},
+					&cli.StringFlag{Name: "default-file-mode", Usage: "octal mode stored for files with --capture-mode default", Value: "0644"},
+					&cli.StringFlag{Name: "default-dir-mode", Usage: "octal mode stored for directories with --capture-mode default", Value: "0755"},
+					&cli.StringFlag{Name: "mode", Usage: "octal mode stored for every file, and for directories with search permission added (e.g. 0644 gives 0755)"},
+					&cli.StringFlag{Name: "file-mode", Usage: "octal mode stored for every file, overriding --mode"},
+					&cli.StringFlag{Name: "dir-mode", Usage: "octal mode stored for every directory, overriding --mode"},
+					&cli.BoolFlag{Name: "store-compressed-types", Value: true, Usage: "store already-compressed files (.jpg, .mp4, .zip, .gz, ...) in zip archives without deflating them"},
+					&cli.IntFlag{Name: "level", Aliases: []string{"L"}, Usage: "compression level, clamped to the range the compressor supports"},
+					&cli.StringSliceFlag{Name: "exclude", Usage: "skip files and directories matching this glob (repeatable)"},
+					&cli.StringFlag{Name: "exclude-from", Usage: "read exclude globs from a file, one per line"},
+					&cli.StringFlag{Name: "comment-file", Usage: "set the archive comment to the contents of this file (zip only)"},
+					&cli.StringFlag{Name: "format", Usage: "archive format to write, e.g. tar.zst, instead of going by the output's extension"},
+					&cli.StringFlag{Name: "password", Usage: "encrypt the archive with this password (--password= prompts for it)"},
+					&cli.StringFlag{Name: "password-file", Usage: "encrypt the archive with the password in this file"},
+					&cli.BoolFlag{Name: "keep-partial", Usage: "keep the output file if creating the archive fails"},
+					&cli.StringFlag{Name: "split", Usage: "write the archive as numbered volumes OUTPUT.000, OUTPUT.001, ... of at most this size (e.g. 2G)"},
+					&cli.BoolFlag{Name: "dry-run", Aliases: []string{"n"}, Usage: "list the entries that would be archived and their total size, without writing the output"},
+					&cli.BoolFlag{Name: "sizes", Aliases: []string{"s"}, Usage: "with --dry-run, show file sizes in bytes"},
+					&cli.BoolFlag{Name: "reproducible", Usage: "write byte-identical archives for identical inputs: sorted entries, fixed times, owners and permissions"},
+					&cli.StringFlag{Name: "mtime", Usage: "store this time as every entry's mtime (default with --reproducible: $SOURCE_DATE_EPOCH, or 1980-01-01)"}),
 				Action: func(ctx context.Context, c *cli.Command) error {
-					return createArchive(ctx, c, c.Args().First(), c.String("output"))
+					return createArchive(ctx, c, c.Args().Slice(), c.String("output"))
 				},
 			},
 			{
@@ -50,55 +199,220 @@ func main() {
 				Aliases:   []string{"e"},
 				Usage:     "extract an archive",
 				ArgsUsage: "<archive>",
-				Flags: append(append(commonFlags(&cli.StringFlag{Name: "output", Aliases: []string{"o"}, Required: true}),
-					&cli.BoolFlag{Name: "flatten", Aliases: []string{"f"}}),
+				Flags: append(append(append(commonFlags(&cli.StringFlag{Name: "output", Aliases: []string{"o"}, Usage: "directory to extract into (required unless --pipe or --to-tar is given)"}),
+					&cli.BoolFlag{Name: "flatten", Aliases: []string{"f"}},
+					&cli.StringFlag{Name: "on-collision", Usage: "with --flatten, what to do with files whose names are already taken: overwrite|skip|rename", Value: "overwrite"}),
 					&cli.StringFlag{Name: "regex", Usage: "include only paths matching this regex"},
-					&cli.StringFlag{Name: "iregex", Usage: "exclude paths matching this regex"}),
+					&cli.StringFlag{Name: "iregex", Usage: "exclude paths matching this regex"},
+					&cli.BoolFlag{Name: "only-regular", Usage: "skip directory, symlink and special entries"},
+					&cli.BoolFlag{Name: "owner-from-current", Usage: "ignore stored ownership and keep extracted files owned by the current user (default when not root)"},
+					&cli.BoolFlag{Name: "same-owner", Usage: "restore stored ownership even when not running as root"},
+					&cli.BoolFlag{Name: "strict-ownership", Usage: "fail instead of warning when stored ownership can't be restored"},
+					&cli.BoolFlag{Name: "unnest", Usage: "recursively extract entries that are themselves archives in place"},
+					&cli.IntFlag{Name: "max-unnest", Usage: "how many levels of nested archives --unnest extracts", Value: 3},
+					&cli.StringFlag{Name: "dir-mode", Usage: "octal mode for extracted directories, overriding the stored one"},
+					&cli.StringFlag{Name: "file-mode", Usage: "octal mode for extracted files, overriding the stored one"},
+					&cli.StringFlag{Name: "pattern", Usage: "only extract files matching a glob pattern"},
+					&cli.StringFlag{Name: "ipattern", Usage: "skip files matching a glob pattern"},
+					&cli.BoolFlag{Name: "match-dirs", Usage: "apply patterns to directory names"},
+					&cli.StringFlag{Name: "anchor", Usage: "match patterns against the entry's: basename|fullpath", Value: "basename"},
+					&cli.BoolFlag{Name: "to-tar", Usage: "write the archive's entries to stdout as an uncompressed tar stream"},
+					&cli.StringFlag{Name: "pipe", Usage: "run this shell command for each file, with its contents on stdin and {} replaced by its name, instead of writing it"},
+					&cli.BoolFlag{Name: "no-symlinks", Usage: "write symlink entries as regular files instead of creating symlinks"},
+					&cli.StringFlag{Name: "overwrite", Usage: "what to do with files that already exist: always|never|newer", Value: "always"},
+					&cli.BoolFlag{Name: "allow-unsafe-paths", Usage: "extract entries whose paths lead outside the output directory"},
+					&cli.BoolFlag{Name: "no-clobber-symlinks", Value: true, Usage: "replace symlinks already in the output directory instead of writing through them"},
+					&cli.BoolFlag{Name: "dedup", Usage: "hardlink files with identical contents and mode instead of writing them again"},
+					&cli.StringFlag{Name: "name-template", Usage: "compute output paths from a Go template with {{.Name}} {{.Dir}} {{.Base}} {{.Stem}} {{.Ext}} {{.Index}}"},
+					&cli.StringFlag{Name: "format", Usage: "archive format to read, e.g. tar.gz, for archives read from stdin whose format can't be told from their content"},
+					&cli.BoolFlag{Name: "progress", Usage: "show a running count of extracted files and bytes on stderr when it is a terminal"},
+					&cli.IntFlag{Name: "jobs", Aliases: []string{"j"}, Usage: "write up to N files at once (zip archives only)", Value: 1},
+					&cli.StringFlag{Name: "max-size", Usage: "stop if the extracted files would total more than this (e.g. 10G)"},
+					&cli.StringFlag{Name: "max-file-size", Usage: "stop if any one extracted file would be larger than this"},
+					&cli.IntFlag{Name: "max-files", Usage: "stop if the archive has more than this many entries to extract"},
+					&cli.BoolFlag{Name: "cleanup-on-error", Usage: "if extraction fails or is interrupted, remove the files and directories it created"},
+					&cli.StringFlag{Name: "password", Usage: "password of an encrypted 7z or rar archive (--password= prompts for it)"},
+					&cli.StringFlag{Name: "password-file", Usage: "read the password of an encrypted 7z or rar archive from this file"}),
+					sigFlags()...),
 				Action: func(ctx context.Context, c *cli.Command) error {
+					if c.Bool("to-tar") {
+						return extractToTar(ctx, c, c.Args().First())
+					}
 					return extractToDirectory(ctx, c, c.Args().First(), c.String("output"))
 				},
 			},
+			{
+				Name:      "convert",
+				Aliases:   []string{"repack"},
+				Usage:     "rewrite an archive in another format",
+				ArgsUsage: "<archive>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "output", Aliases: []string{"o"}, Required: true},
+					&cli.IntFlag{Name: "level", Aliases: []string{"L"}, Usage: "compression level, clamped to the range the compressor supports"},
+					&cli.BoolFlag{Name: "store-compressed-types", Value: true, Usage: "store already-compressed files (.jpg, .mp4, .zip, .gz, ...) in zip archives without deflating them"},
+					&cli.BoolFlag{Name: "verbose", Aliases: []string{"v"}, Usage: "list entries on stderr as they are processed"},
+					&cli.IntFlag{Name: "progress-every", Usage: "with --verbose, only list every Nth entry (and the last one)"},
+				},
+				Action: func(ctx context.Context, c *cli.Command) error {
+					return convertArchive(ctx, c, c.Args().First(), c.String("output"))
+				},
+			},
+			{
+				Name:      "add",
+				Aliases:   []string{"append"},
+				Usage:     "add files or directories to an existing archive",
+				ArgsUsage: "<archive> <source>...",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "replace", Usage: "replace entries that already exist in the archive"},
+					&cli.BoolFlag{Name: "store-compressed-types", Value: true, Usage: "store already-compressed files (.jpg, .mp4, .zip, .gz, ...) in zip archives without deflating them"},
+				},
+				Action: func(ctx context.Context, c *cli.Command) error {
+					return addToArchive(ctx, c, c.Args().First(), c.Args().Tail())
+				},
+			},
+			{
+				Name:      "test",
+				Aliases:   []string{"verify", "t"},
+				Usage:     "check that every entry of an archive can be read back",
+				ArgsUsage: "<archive>",
+				Flags: append([]cli.Flag{
+					&cli.BoolFlag{Name: "summary-only", Usage: "only print the result and any failing entries"},
+					&cli.BoolFlag{Name: "json", Usage: "print the result as JSON"},
+				}, sigFlags()...),
+				Action: verifyArchive,
+			},
+			{
+				Name:      "manifest",
+				Aliases:   []string{"checksum"},
+				Usage:     "print a sha256sum-style manifest of an archive's files, or check one",
+				ArgsUsage: "<archive>",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{Name: "algo", Usage: "digest to compute: md5|sha1|sha256|crc32", Value: "sha256"},
+					&cli.StringFlag{Name: "output", Aliases: []string{"o"}, Usage: "write the manifest to this file instead of stdout"},
+					&cli.StringFlag{Name: "check", Aliases: []string{"c"}, Usage: "verify the archive against this manifest instead"},
+				}, sigFlags()...),
+				Action: manifestArchive,
+			},
+			{
+				Name:      "cat",
+				Usage:     "write the contents of archive entries to stdout",
+				ArgsUsage: "<archive> <entry>...",
+				Flags: append([]cli.Flag{
+					&cli.BoolFlag{Name: "include-all", Usage: "also print symlink targets for entries matched by a glob"},
+					&cli.StringFlag{Name: "limit", Usage: "stop after this many bytes of each entry (e.g. 4K)"},
+					&cli.IntFlag{Name: "head", Usage: "only print the first N lines of each entry"},
+					&cli.IntFlag{Name: "tail", Usage: "only print the last N lines of each entry"},
+				}, sigFlags()...),
+				Action:        catArchive,
+				ShellComplete: completeEntries(0, true),
+			},
+			{
+				Name:      "grep",
+				Usage:     "search the contents of an archive's files for a regular expression",
+				ArgsUsage: "<regexp> <archive>",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{Name: "regexp", Aliases: []string{"e"}, Usage: "regular expression to search for, instead of the first argument"},
+					&cli.BoolFlag{Name: "ignore-case", Aliases: []string{"i"}, Usage: "match case-insensitively"},
+					&cli.BoolFlag{Name: "files-with-matches", Aliases: []string{"l"}, Usage: "only print the names of files with a match"},
+					&cli.StringFlag{Name: "pattern", Usage: "only search files matching this glob pattern"},
+					&cli.StringFlag{Name: "ipattern", Usage: "skip files matching this glob pattern"},
+					&cli.StringFlag{Name: "anchor", Usage: "match patterns against the entry's: basename|fullpath", Value: "basename"},
+					&cli.StringFlag{Name: "binary", Usage: "how to treat binary files: skip|text", Value: "skip"},
+				}, sigFlags()...),
+				Action: grepArchive,
+			},
+			{
+				Name:      "mount",
+				Usage:     "mount an archive as a read-only filesystem (Linux and macOS, needs FUSE)",
+				ArgsUsage: "<archive> <mountpoint>",
+				Flags:     sigFlags(),
+				Action:    mountArchive,
+			},
+			{
+				Name:      "stat",
+				Usage:     "print the metadata of a single archive entry",
+				ArgsUsage: "<archive> <entry>",
+				Flags: append([]cli.Flag{
+					&cli.BoolFlag{Name: "follow-links", Aliases: []string{"L"}, Usage: "describe what a symlink entry points to instead"},
+					&cli.BoolFlag{Name: "json", Usage: "print output as JSON"},
+					&cli.BoolFlag{Name: "utc", Usage: "display times in UTC instead of the local timezone"},
+				}, sigFlags()...),
+				Action:        statEntry,
+				ShellComplete: completeEntries(1, false),
+			},
+			{
+				Name:  "list-formats",
+				Usage: "list the archive formats xpld can create and extract",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "detailed", Usage: "print a table of everything each format supports"},
+					&cli.BoolFlag{Name: "json", Usage: "print output as JSON"},
+				},
+				Action: listFormats,
+			},
 			{
 				Name:      "inspect",
 				Aliases:   []string{"i"},
 				Usage:     "inspect archive contents",
 				ArgsUsage: "<archive>",
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					&cli.BoolFlag{Name: "json", Usage: "print output as JSON"},
+					&cli.BoolFlag{Name: "ndjson", Usage: "print output as JSON lines, one object per entry"},
+					&cli.BoolFlag{Name: "csv", Usage: "print output as CSV"},
+					&cli.StringFlag{Name: "fields", Usage: "with --json, --ndjson or --csv, only print these comma-separated fields, in this order"},
 					&cli.BoolFlag{Name: "txt", Usage: "force plain text output"},
+					&cli.BoolFlag{Name: "porcelain", Usage: "print stable, tab-separated output for scripts"},
+					&cli.BoolFlag{Name: "top-dirs", Usage: "only print top-level entries with their file counts and total sizes"},
+					&cli.BoolFlag{Name: "tar", Usage: "print output in the same format as `tar -tv`"},
+					&cli.BoolFlag{Name: "numeric-owner", Usage: "print numeric user and group IDs instead of names"},
 					&cli.BoolFlag{Name: "tree", Usage: "draw a tree of the archive contents"},
 					&cli.BoolFlag{Name: "color", Aliases: []string{"c"}, Usage: "enable ANSI color"},
 					&cli.BoolFlag{Name: "sizes", Aliases: []string{"s"}, Usage: "show file sizes in bytes"},
-					&cli.StringFlag{Name: "sort", Usage: "sort by: name|extension|version|size|atime|ctime|mtime", Value: "name"},
+					&cli.BoolFlag{Name: "classify-content", Usage: "label each file as text or binary by sniffing its first bytes"},
+					&cli.StringFlag{Name: "checksum", Usage: "print a digest of each file's contents: md5|sha1|sha256|crc32"},
+					&cli.BoolFlag{Name: "recursive", Aliases: []string{"R"}, Usage: "also list the contents of entries that are themselves archives"},
+					&cli.IntFlag{Name: "max-recursion", Usage: "how many levels of nested archives --recursive lists", Value: 3},
+					&cli.BoolFlag{Name: "long", Aliases: []string{"l"}, Usage: "use an `ls -l` style listing with mode, owner, size, mtime and symlink targets"},
+					&cli.StringFlag{Name: "sort", Usage: "sort by comma-separated keys, each optionally prefixed with - to sort descending: name|extension|version|size|time|atime|ctime|mtime|dirs-first", Value: "name"},
+					&cli.StringFlag{Name: "time-field", Usage: "time --sort time orders by: mtime|ctime|atime", Value: "mtime"},
 					&cli.BoolFlag{Name: "reverse", Aliases: []string{"r"}, Usage: "reverse the sort order"},
+					&cli.IntFlag{Name: "top", Usage: "only list the first N entries after sorting"},
+					&cli.BoolFlag{Name: "no-sort", Usage: "list entries in archive order, printing them as they are read where possible"},
 					&cli.BoolFlag{Name: "dirs-first", Aliases: []string{"d"}, Usage: "list directories before files"},
 					&cli.BoolFlag{Name: "all", Aliases: []string{"a"}, Usage: "include hidden files"},
 					&cli.BoolFlag{Name: "dirs-only", Usage: "list directories only"},
-					&cli.BoolFlag{Name: "full-path", Usage: "print full path for each entry"},
+					&cli.BoolFlag{Name: "full-path", Usage: "with --tree, print each entry's full path in the archive instead of its base name"},
 					&cli.BoolFlag{Name: "ignore-case", Usage: "ignore case when matching or sorting"},
 					&cli.BoolFlag{Name: "follow-links", Usage: "follow symlinks as directories"},
-					&cli.IntFlag{Name: "depth", Usage: "limit directory traversal depth"},
+					&cli.IntFlag{Name: "depth", Usage: "limit directory traversal depth (1 lists top-level entries only, 0 is unlimited)"},
 					&cli.StringFlag{Name: "pattern", Usage: "only list files matching a glob pattern"},
 					&cli.StringFlag{Name: "ipattern", Usage: "exclude files matching a glob pattern"},
-					&cli.BoolFlag{Name: "match-dirs", Usage: "apply patterns to directory names"},
+					&cli.StringFlag{Name: "min-size", Usage: "only list files at least this large (e.g. 10M)"},
+					&cli.StringFlag{Name: "max-size", Usage: "only list files at most this large (e.g. 1G)"},
+					&cli.BoolFlag{Name: "match-dirs", Usage: "apply patterns and size limits to directories"},
+					&cli.StringFlag{Name: "anchor", Usage: "match patterns against the entry's: basename|fullpath", Value: "basename"},
 					&cli.BoolFlag{Name: "prune", Usage: "prune empty directories from the output"},
 					&cli.BoolFlag{Name: "unit-size", Usage: "print sizes in human-readable units"},
 					&cli.BoolFlag{Name: "show-uid", Usage: "display file owner UID"},
 					&cli.BoolFlag{Name: "show-gid", Usage: "display file group GID"},
 					&cli.BoolFlag{Name: "last-mod", Usage: "display last modification time"},
+					&cli.BoolFlag{Name: "utc", Usage: "display times in UTC instead of the local timezone"},
+					&cli.StringFlag{Name: "timezone", Usage: "display times in this timezone: UTC, Local or an IANA name such as Europe/Berlin"},
+					&cli.StringFlag{Name: "time-format", Usage: "format times as iso, unix, rfc822 or a Go layout such as 2006-01-02"},
+					&cli.BoolFlag{Name: "relative-time", Aliases: []string{"human-time"}, Usage: "in text and --long output, show mtimes relative to now, e.g. 3 days ago (implies --last-mod)"},
 					&cli.BoolFlag{Name: "quotes", Usage: "quote file names"},
 					&cli.BoolFlag{Name: "inodes", Usage: "show inode number"},
 					&cli.BoolFlag{Name: "device", Usage: "show device ID"},
 					&cli.BoolFlag{Name: "no-indent", Usage: "disable tree indentation"},
-				},
+					&cli.BoolFlag{Name: "no-trailing-newline", Usage: "do not terminate the output with a newline"},
+					&cli.BoolFlag{Name: "ratio", Usage: "show each file's compressed/uncompressed size ratio, where the format records it"},
+					&cli.BoolFlag{Name: "skip-special", Usage: "omit device, FIFO and socket entries"},
+					&cli.BoolFlag{Name: "summary", Usage: "also print the number of files and directories and their total size"},
+					&cli.BoolFlag{Name: "no-pager", Usage: "do not page output through $PAGER on a terminal"},
+				}, sigFlags()...),
 				Action: inspectArchive,
 			},
 		},
 	}
-	if err := app.Run(context.Background(), os.Args); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
-	}
 }
 
 func commonFlags(output *cli.StringFlag) []cli.Flag {
@@ -106,398 +420,2345 @@ func commonFlags(output *cli.StringFlag) []cli.Flag {
 		output,
 		&cli.BoolFlag{Name: "preserve-ownership", Value: true, Usage: "preserve entry ownership when extracting"},
 		&cli.BoolFlag{Name: "preserve-permissions", Value: true, Usage: "preserve entry permissions when extracting"},
-		&cli.BoolFlag{Name: "ignore-root-ownership", Usage: "ignore root's ownership of entries"},
+		&cli.BoolFlag{Name: "preserve-mtime", Value: true, Usage: "restore entry modification times when extracting"},
+		&cli.BoolFlag{Name: "ignore-root-ownership", Usage: "leave entries owned by root (uid or gid 0) owned by the extracting user"},
 		&cli.BoolFlag{Name: "uid-ownership", Value: true, Usage: "preserve only UID"},
+		&cli.BoolFlag{Name: "verbose", Aliases: []string{"v"}, Usage: "list entries on stderr as they are processed"},
+		&cli.IntFlag{Name: "progress-every", Usage: "with --verbose, only list every Nth entry (and the last one)"},
+		&cli.BoolFlag{Name: "profile", Usage: "report the slowest entries to process on stderr"},
+		&cli.IntFlag{Name: "profile-top", Usage: "how many entries --profile reports", Value: 10},
 	}
 }
 
-func createArchive(ctx context.Context, c *cli.Command, src, dst string) error {
-	if src == "" || dst == "" {
-		return errors.New("source and output are required")
+// entryProfiler records how long each entry took to read and write, so that
+// --profile can point out the slow ones.
+type entryProfiler struct {
+	enabled bool
+	top     int
+	base    int64
+	entries []entryTiming
+}
+
+type entryTiming struct {
+	name    string
+	size    int64
+	elapsed time.Duration
+}
+
+func newEntryProfiler(c *cli.Command) *entryProfiler {
+	return &entryProfiler{enabled: c.Bool("profile"), top: c.Int("profile-top"), base: unitBase(c)}
+}
+
+func (p *entryProfiler) record(name string, size int64, elapsed time.Duration) {
+	if p.enabled {
+		p.entries = append(p.entries, entryTiming{name, size, elapsed})
 	}
-	outFile, err := os.Create(dst)
-	if err != nil {
-		return err
+}
+
+// report prints the slowest entries as a table on stderr.
+func (p *entryProfiler) report() {
+	if !p.enabled || len(p.entries) == 0 {
+		return
+	}
+	sort.Slice(p.entries, func(i, j int) bool { return p.entries[i].elapsed > p.entries[j].elapsed })
+	if p.top > 0 && len(p.entries) > p.top {
+		p.entries = p.entries[:p.top]
+	}
+	fmt.Fprintf(os.Stderr, "%12s %8s  %s\n", "TIME", "SIZE", "NAME")
+	for _, e := range p.entries {
+		fmt.Fprintf(os.Stderr, "%12s %8s  %s\n", e.elapsed.Round(time.Microsecond), xpld.FormatBytes(e.size, p.base), e.name)
 	}
-	defer outFile.Close()
+}
 
-	format, _, err := archives.Identify(ctx, dst, nil)
-	if err != nil {
-		return err
+// verboseLog lists processed entries on stderr for --verbose, sampling
+// every Nth one when --progress-every is set.
+type verboseLog struct {
+	enabled bool
+	every   int
+	count   int
+	last    string
+}
+
+func newVerboseLog(c *cli.Command) *verboseLog {
+	return &verboseLog{enabled: c.Bool("verbose"), every: c.Int("progress-every")}
+}
+
+func (v *verboseLog) log(name string) {
+	if !v.enabled {
+		return
 	}
-	archiver, ok := format.(archives.Archiver)
-	if !ok {
-		return fmt.Errorf("unsupported archive format")
+	v.count++
+	if v.every > 1 && v.count%v.every != 0 {
+		v.last = name
+		return
 	}
+	v.last = ""
+	fmt.Fprintln(os.Stderr, name)
+}
 
-	var includeRe, excludeRe *regexp.Regexp
-	if regex := c.String("regex"); regex != "" {
-		re, err := regexp.Compile(regex)
-		if err != nil {
-			return fmt.Errorf("invalid regex for include: %w", err)
-		}
-		includeRe = re
+// done prints the final entry if sampling skipped it.
+func (v *verboseLog) done() {
+	if v.enabled && v.last != "" {
+		fmt.Fprintln(os.Stderr, v.last)
 	}
-	if iregex := c.String("iregex"); iregex != "" {
-		re, err := regexp.Compile(iregex)
-		if err != nil {
-			return fmt.Errorf("invalid regex for exclude: %w", err)
-		}
-		excludeRe = re
+}
+
+// progressMeter keeps a count of extracted files and bytes on one line of
+// stderr for --progress, redrawn at most every 100ms. It's only shown when
+// stderr is a terminal, as the redrawing would garble a log file.
+type progressMeter struct {
+	mu      sync.Mutex
+	enabled bool
+	base    int64
+	files   int
+	bytes   int64
+	drawn   time.Time
+	shown   bool
+}
+
+func newProgressMeter(c *cli.Command) *progressMeter {
+	return &progressMeter{enabled: c.Bool("progress") && isTTY(c, os.Stderr), base: unitBase(c)}
+}
+
+// file counts an entry as it starts being extracted.
+func (p *progressMeter) file() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.files++
+	p.draw(false)
+}
+
+// Write counts bytes as they are copied into extracted files.
+func (p *progressMeter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.bytes += int64(len(b))
+	p.draw(false)
+	return len(b), nil
+}
+
+func (p *progressMeter) draw(force bool) {
+	if !p.enabled || !force && time.Since(p.drawn) < 100*time.Millisecond {
+		return
 	}
+	p.drawn = time.Now()
+	p.shown = true
+	fmt.Fprintf(os.Stderr, "\r\033[K%d files, %s", p.files, xpld.FormatBytes(p.bytes, p.base))
+}
 
-	var inputs []archives.FileInfo
-	err = filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
+// clear erases the meter, so --verbose can print a line in its place.
+func (p *progressMeter) clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.shown {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+		p.shown = false
+	}
+}
+
+// done draws the final count and ends its line.
+func (p *progressMeter) done() {
+	if p.enabled && p.files > 0 {
+		p.draw(true)
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// warn prints a warning from the xpld package on stderr.
+func warn(msg string) {
+	fmt.Fprintln(os.Stderr, "xpld: "+msg)
+}
+
+// openSource opens a file being archived, once the archiver gets to it. It
+// is a variable so that tests can make archiving fail partway.
+var openSource = os.Open
+
+// createArchive archives each of srcs into dst with xpld.Create, taking its
+// options from c's flags.
+func createArchive(ctx context.Context, c *cli.Command, srcs []string, dst string) error {
+	if len(srcs) == 0 || dst == "" {
+		return errors.New("source and output are required")
+	}
+	opts := xpld.CreateOptions{
+		Sources:         srcs,
+		Output:          dst,
+		StoreCompressed: c.Bool("store-compressed-types"),
+		KeepPartial:     c.Bool("keep-partial"),
+		Dereference:     c.Bool("dereference"),
+		NoRecursion:     c.Bool("no-recursion"),
+		Reproducible:    c.Bool("reproducible"),
+		DryRun:          c.Bool("dry-run"),
+		Open:            openSource,
+		Warn:            warn,
+	}
+	switch mode := c.String("link-name-mode"); mode {
+	case "link":
+	case "target":
+		opts.TargetNames = true
+	default:
+		return fmt.Errorf("invalid link name mode %q, must be link or target", mode)
+	}
+	// Permissions stored in place of the files' own, if set
+	var fileMode, dirMode fs.FileMode
+	switch c.String("capture-mode") {
+	case "disk":
+	case "default":
+		var err error
+		if fileMode, err = parseMode(c.String("default-file-mode")); err != nil {
+			return fmt.Errorf("invalid default file mode: %w", err)
 		}
-		rel, err := filepath.Rel(src, path)
-		if err != nil {
-			return err
+		if dirMode, err = parseMode(c.String("default-dir-mode")); err != nil {
+			return fmt.Errorf("invalid default dir mode: %w", err)
 		}
-		if includeRe != nil && !includeRe.MatchString(rel) {
-			return nil
+		opts.FileMode, opts.DirMode = &fileMode, &dirMode
+	default:
+		return fmt.Errorf("invalid capture mode %q, must be disk or default", c.String("capture-mode"))
+	}
+	if s := c.String("mode"); s != "" {
+		m, err := parseMode(s)
+		if err != nil {
+			return fmt.Errorf("invalid mode: %w", err)
 		}
-		if excludeRe != nil && excludeRe.MatchString(rel) {
-			return nil
+		// Like chmod's X, directories are searchable by whoever can read them
+		fileMode, dirMode = m, m|(m&0o444)>>2
+		opts.FileMode, opts.DirMode = &fileMode, &dirMode
+	}
+	if s := c.String("file-mode"); s != "" {
+		var err error
+		if fileMode, err = parseMode(s); err != nil {
+			return fmt.Errorf("invalid file mode: %w", err)
 		}
-		info, err := d.Info()
-		if err != nil {
-			return err
+		opts.FileMode = &fileMode
+	}
+	if s := c.String("dir-mode"); s != "" {
+		var err error
+		if dirMode, err = parseMode(s); err != nil {
+			return fmt.Errorf("invalid dir mode: %w", err)
 		}
-		inputs = append(inputs, archives.FileInfo{
-			NameInArchive: rel,
-			FileInfo:      info,
-			Open: func() (fs.File, error) {
-				if info.IsDir() {
-					return nil, nil
-				}
-				return os.Open(path)
-			},
-		})
-		return nil
-	})
+		opts.DirMode = &dirMode
+	}
+	mtime, fromEnv, err := createMtime(c)
 	if err != nil {
 		return err
 	}
-	return archiver.Archive(ctx, outFile, inputs)
-}
-
-func extractToDirectory(ctx context.Context, c *cli.Command, tarball, dst string) error {
-	if tarball == "" || dst == "" {
-		return errors.New("archive path and output directory are required")
+	if c.IsSet("mtime") || fromEnv || opts.Reproducible {
+		opts.Mtime = mtime
 	}
-	f, err := os.Open(tarball)
-	if err != nil {
+	// Following the SOURCE_DATE_EPOCH spec, only times after it are changed
+	opts.ClampMtime = fromEnv && !opts.Reproducible
+	if opts.Owner, err = createOwner(c); err != nil {
 		return err
 	}
-	defer f.Close()
-
-	format, input, err := archives.Identify(ctx, tarball, f)
-	if err != nil {
+	// Writing to stdout, there is no file name to tell the format from
+	if dst == "-" {
+		if c.String("format") == "" {
+			return errors.New("writing to stdout requires --format")
+		}
+		if isTTY(c, os.Stdout) && !opts.DryRun {
+			return errors.New("refusing to write an archive to a terminal")
+		}
+	}
+	if s := c.String("split"); s != "" {
+		if opts.Split, err = xpld.ParseBytes(s, unitBase(c)); err != nil {
+			return fmt.Errorf("invalid split size: %w", err)
+		}
+		if opts.Split <= 0 {
+			return errors.New("split size must be positive")
+		}
+	}
+	if opts.Format, err = outputFormat(ctx, c, dst); err != nil {
 		return err
 	}
-	extractor, ok := format.(archives.Extractor)
-	if !ok {
-		return fmt.Errorf("unsupported archive format")
+	if c.IsSet("password") || c.IsSet("password-file") {
+		// mholt/archives can decrypt 7z and rar, but write no encrypted format
+		return fmt.Errorf("%s archives can't be encrypted, xpld has no format that supports encryption", strings.TrimPrefix(opts.Format.Extension(), "."))
+	}
+	if c.IsSet("level") {
+		level := c.Int("level")
+		opts.Level = &level
+	}
+	if path := c.String("comment-file"); path != "" {
+		if opts.Comment, err = os.ReadFile(path); err != nil {
+			return err
+		}
 	}
-
-	var includeRe, excludeRe *regexp.Regexp
 	if regex := c.String("regex"); regex != "" {
-		re, err := regexp.Compile(regex)
-		if err != nil {
+		if opts.Regex, err = regexp.Compile(regex); err != nil {
 			return fmt.Errorf("invalid regex for include: %w", err)
 		}
-		includeRe = re
 	}
 	if iregex := c.String("iregex"); iregex != "" {
-		re, err := regexp.Compile(iregex)
-		if err != nil {
+		if opts.IRegex, err = regexp.Compile(iregex); err != nil {
 			return fmt.Errorf("invalid regex for exclude: %w", err)
 		}
-		excludeRe = re
 	}
-
-	return extractor.Extract(ctx, input, func(ctx context.Context, fi archives.FileInfo) error {
-		name := fi.NameInArchive
-		if includeRe != nil && !includeRe.MatchString(name) {
-			return nil
-		}
-		if excludeRe != nil && excludeRe.MatchString(name) {
-			return nil
-		}
-		if c.Bool("flatten") {
-			name = filepath.Base(name)
+	opts.Exclude = c.StringSlice("exclude")
+	if from := c.String("exclude-from"); from != "" {
+		data, err := os.ReadFile(from)
+		if err != nil {
+			return err
 		}
-		path := filepath.Join(dst, name)
-		if fi.IsDir() {
-			mode := fi.FileInfo.Mode()
-			if !c.Bool("preserve-permissions") {
-				mode = 0755
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				opts.Exclude = append(opts.Exclude, line)
 			}
-			return os.MkdirAll(path, mode)
 		}
-		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
-			return err
+	}
+
+	vlog := newVerboseLog(c)
+	prof := newEntryProfiler(c)
+	opts.Log = vlog.log
+	if prof.enabled {
+		opts.Profile = prof.record
+	}
+	entries, err := xpld.Create(ctx, opts)
+	vlog.done()
+	if err != nil {
+		return err
+	}
+	// A dry run lists the entries the way inspect would once they are
+	// archived, and stops before anything is written
+	if opts.DryRun {
+		var sum inspectSummary
+		for _, e := range entries {
+			f := fileEntry{name: e.Name, info: e.Info}
+			sum.add(f)
+			fmt.Println(textEntry(c, f))
 		}
-		r, err := fi.Open()
-		if err != nil {
-			return err
+		fmt.Println(textSummary(c, sum))
+		return nil
+	}
+	prof.report()
+	return nil
+}
+
+// outputFormat returns the format to write dst in: the one --format names,
+// or else the one dst's extension implies.
+func outputFormat(ctx context.Context, c *cli.Command, dst string) (archives.Format, error) {
+	name := dst
+	if f := c.String("format"); f != "" {
+		name = "archive." + strings.TrimPrefix(f, ".")
+	}
+	format, _, err := archives.Identify(ctx, name, nil)
+	if err != nil && !errors.Is(err, archives.NoMatch) {
+		return nil, err
+	}
+	if _, ok := format.(archives.Archiver); ok {
+		return format, nil
+	}
+	var supported []string
+	for _, f := range knownFormats {
+		if info := describeFormat(f); info.Create {
+			supported = append(supported, info.Name)
 		}
-		defer r.Close()
-		w, err := os.Create(path)
+	}
+	if c.String("format") != "" {
+		return nil, fmt.Errorf("can't create %s archives, --format must be one of: %s", c.String("format"), strings.Join(supported, ", "))
+	}
+	if suggestion := suggestFormat(dst); suggestion != "" {
+		return nil, fmt.Errorf("can't tell which format to write %s in from its name, did you mean .%s? Use --format with one of: %s", dst, suggestion, strings.Join(supported, ", "))
+	}
+	return nil, fmt.Errorf("can't tell which format to write %s in from its name, use --format with one of: %s", dst, strings.Join(supported, ", "))
+}
+
+// createOwner parses --owner and --group, returning nil if neither is set.
+func createOwner(c *cli.Command) (*xpld.OwnerOverride, error) {
+	if c.String("owner") == "" && c.String("group") == "" {
+		return nil, nil
+	}
+	o := &xpld.OwnerOverride{}
+	var err error
+	if s := c.String("owner"); s != "" {
+		o.SetUser = true
+		o.UID, o.User, err = parseOwnerSpec(s, func(name string) (string, error) {
+			u, err := osuser.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
 		if err != nil {
-			return err
-		}
-		defer w.Close()
-		if _, err := io.Copy(w, r); err != nil {
-			return err
+			return nil, fmt.Errorf("invalid --owner: %w", err)
 		}
-		if c.Bool("preserve-permissions") {
-			if err := os.Chmod(path, fi.FileInfo.Mode()); err != nil {
-				return err
+	}
+	if s := c.String("group"); s != "" {
+		o.SetGroup = true
+		o.GID, o.Group, err = parseOwnerSpec(s, func(name string) (string, error) {
+			g, err := osuser.LookupGroup(name)
+			if err != nil {
+				return "", err
 			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid --group: %w", err)
 		}
-		if c.Bool("preserve-ownership") || c.Bool("uid-ownership") {
-			if stat, ok := fi.FileInfo.Sys().(interface{ Uid() int; Gid() int }); ok {
-				uid := stat.Uid()
-				if !c.Bool("uid-ownership") {
-					uid = -1
-				}
-				if err := os.Chown(path, uid, stat.Gid()); err != nil {
-					return err
-				}
+	}
+	return o, nil
+}
+
+// parseOwnerSpec parses an owner or group given as a name, a numeric ID or
+// name:ID, like GNU tar. A bare name is looked up on this system with
+// lookup; a bare ID is stored without a name, so the archive doesn't depend
+// on the local user database.
+func parseOwnerSpec(spec string, lookup func(name string) (string, error)) (id int, name string, err error) {
+	name, idStr, hasID := strings.Cut(spec, ":")
+	if !hasID {
+		if id, err := strconv.Atoi(spec); err == nil {
+			if id < 0 {
+				return 0, "", fmt.Errorf("%q is not a valid ID", spec)
 			}
+			return id, "", nil
 		}
-		return nil
-	})
+		if idStr, err = lookup(name); err != nil {
+			return 0, "", fmt.Errorf("%s: %w, give its ID as %s:ID", name, err, name)
+		}
+	}
+	if id, err = strconv.Atoi(idStr); err != nil || id < 0 {
+		return 0, "", fmt.Errorf("%q is not a valid ID", idStr)
+	}
+	return id, name, nil
 }
 
-type fileEntry struct{ name string; info fs.FileInfo }
-type treeFS struct{ fsys fs.FS }
-
-func (tfs treeFS) ReadDir(dirname string) ([]string, error) {
-	entries, err := fs.ReadDir(tfs.fsys, dirname)
-	if err != nil {
-		return nil, err
+// createMtime returns the mtime create stores: --mtime as Unix seconds,
+// RFC 3339 or a date, else $SOURCE_DATE_EPOCH, reporting that it came from
+// the environment, else 1980-01-01, the earliest time every format can
+// represent.
+func createMtime(c *cli.Command) (t time.Time, fromEnv bool, err error) {
+	s := c.String("mtime")
+	if s == "" {
+		epoch := os.Getenv("SOURCE_DATE_EPOCH")
+		if epoch == "" {
+			return time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC), false, nil
+		}
+		sec, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q, must be Unix seconds", epoch)
+		}
+		return time.Unix(sec, 0).UTC(), true, nil
 	}
-	names := make([]string, len(entries))
-	for i, e := range entries {
-		name := e.Name()
-		if e.IsDir() && !strings.HasSuffix(name, "/") {
-			name += "/"
+	if sec, err := strconv.ParseInt(strings.TrimPrefix(s, "@"), 10, 64); err == nil {
+		return time.Unix(sec, 0).UTC(), false, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), false, nil
 		}
-		names[i] = name
 	}
-	return names, nil
+	return time.Time{}, false, fmt.Errorf("invalid mtime %q, must be Unix seconds, RFC 3339 or YYYY-MM-DD", s)
 }
-func (tfs treeFS) Stat(name string) (os.FileInfo, error) {
-	f, err := tfs.fsys.Open(name)
-	if err != nil {
-		return nil, err
+
+// parseMode parses an octal permission string such as "0644".
+func parseMode(s string) (fs.FileMode, error) {
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m > uint64(fs.ModePerm) {
+		return 0, fmt.Errorf("%q is not an octal permission mode", s)
 	}
-	defer f.Close()
-	return f.Stat()
+	return fs.FileMode(m), nil
 }
 
-func inspectArchive(ctx context.Context, c *cli.Command) error {
-	f, err := os.Open(c.Args().First())
-	if err != nil {
-		return err
+// extractToDirectory extracts archive into dst with xpld.Extract, taking its
+// options from c's flags.
+func extractToDirectory(ctx context.Context, c *cli.Command, archive, dst string) error {
+	if archive == "" || dst == "" && c.String("pipe") == "" {
+		return errors.New("archive path and output directory are required")
 	}
-	defer f.Close()
-
-	_, _, err = archives.Identify(ctx, c.Args().First(), f)
-	if err != nil {
+	if anchor := c.String("anchor"); anchor != "basename" && anchor != "fullpath" {
+		return fmt.Errorf("invalid anchor %q, must be basename or fullpath", anchor)
+	}
+	if archive == "-" && c.Bool("verify-sig") {
+		return errors.New("--verify-sig can't check an archive read from stdin")
+	}
+	if err := verifySignature(c, archive); err != nil {
 		return err
 	}
-	fsys, err := archives.FileSystem(ctx, c.Args().First(), f)
+	filter, err := entryFilter(c)
 	if err != nil {
 		return err
 	}
-
-	var files []fileEntry
-	err = fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
+	opts := xpld.ExtractOptions{
+		Archive:             archive,
+		Format:              c.String("format"),
+		Password:            passwordFunc(c),
+		Output:              dst,
+		Filter:              filter,
+		Overwrite:           c.String("overwrite"),
+		Flatten:             c.Bool("flatten"),
+		OnCollision:         c.String("on-collision"),
+		Pipe:                c.String("pipe"),
+		AllowUnsafePaths:    c.Bool("allow-unsafe-paths"),
+		NoSymlinks:          c.Bool("no-symlinks"),
+		NoClobberSymlinks:   c.Bool("no-clobber-symlinks"),
+		PreservePermissions: c.Bool("preserve-permissions"),
+		PreserveMtime:       c.Bool("preserve-mtime"),
+		RestoreOwnership:    restoreOwnership(c),
+		RestoreUID:          c.Bool("uid-ownership"),
+		IgnoreRootOwnership: c.Bool("ignore-root-ownership"),
+		StrictOwnership:     c.Bool("strict-ownership"),
+		Dedup:               c.Bool("dedup"),
+		Jobs:                c.Int("jobs"),
+		Unnest:              c.Bool("unnest"),
+		MaxUnnest:           c.Int("max-unnest"),
+		CleanupOnError:      c.Bool("cleanup-on-error"),
+		MaxFiles:            c.Int("max-files"),
+		UnitBase:            unitBase(c),
+	}
+	var fileMode, dirMode fs.FileMode
+	if s := c.String("file-mode"); s != "" {
+		if fileMode, err = parseMode(s); err != nil {
+			return fmt.Errorf("invalid file mode: %w", err)
 		}
-		if c.Bool("dirs-only") && !d.IsDir() {
-			return nil
+		opts.FileMode = &fileMode
+	}
+	if s := c.String("dir-mode"); s != "" {
+		if dirMode, err = parseMode(s); err != nil {
+			return fmt.Errorf("invalid dir mode: %w", err)
 		}
-		if c.String("pattern") != "" {
-			if ok, _ := filepath.Match(c.String("pattern"), d.Name()); !ok && (!c.Bool("match-dirs") || !d.IsDir()) {
-				return nil
-			}
+		opts.DirMode = &dirMode
+	}
+	if tmpl := c.String("name-template"); tmpl != "" {
+		if opts.NameTemplate, err = template.New("name").Parse(tmpl); err != nil {
+			return fmt.Errorf("invalid name template: %w", err)
 		}
-		if c.String("ipattern") != "" {
-			if ok, _ := filepath.Match(c.String("ipattern"), d.Name()); ok && (!c.Bool("match-dirs") || !d.IsDir()) {
-				return nil
-			}
+	}
+	if s := c.String("max-size"); s != "" {
+		if opts.MaxSize, err = xpld.ParseBytes(s, unitBase(c)); err != nil {
+			return fmt.Errorf("invalid max size: %w", err)
 		}
-		if c.Int("depth") > 0 && strings.Count(path, "/")+1 > c.Int("depth") {
-			if d.IsDir() {
+	}
+	if s := c.String("max-file-size"); s != "" {
+		if opts.MaxFileSize, err = xpld.ParseBytes(s, unitBase(c)); err != nil {
+			return fmt.Errorf("invalid max file size: %w", err)
+		}
+	}
+
+	vlog := newVerboseLog(c)
+	prof := newEntryProfiler(c)
+	meter := newProgressMeter(c)
+	opts.OnEntry = func(name string) {
+		meter.clear()
+		vlog.log(name)
+		meter.file()
+	}
+	if meter.enabled {
+		opts.Progress = meter
+	}
+	if prof.enabled {
+		opts.Profile = prof.record
+	}
+	opts.Warn = func(msg string) {
+		meter.clear()
+		warn(msg)
+	}
+	stats, err := xpld.Extract(ctx, opts)
+	vlog.done()
+	meter.done()
+	prof.report()
+	if stats.Unowned > 1 {
+		fmt.Fprintf(os.Stderr, "xpld: couldn't restore the ownership of %d files\n", stats.Unowned)
+	}
+	if stats.Deduplicated > 0 {
+		fmt.Fprintf(os.Stderr, "dedup: hardlinked %d duplicate files, saving %s\n", stats.Deduplicated, xpld.FormatBytes(stats.DedupSaved, unitBase(c)))
+	}
+	return err
+}
+
+// entryFilter returns the filter that selects the entries to extract, set
+// with --regex, --iregex, --pattern, --ipattern, --match-dirs and
+// --only-regular.
+func entryFilter(c *cli.Command) (xpld.Filter, error) {
+	f := xpld.Filter{
+		Pattern:     c.String("pattern"),
+		IPattern:    c.String("ipattern"),
+		FullPath:    c.String("anchor") == "fullpath",
+		MatchDirs:   c.Bool("match-dirs"),
+		OnlyRegular: c.Bool("only-regular"),
+	}
+	var err error
+	if regex := c.String("regex"); regex != "" {
+		if f.Regex, err = regexp.Compile(regex); err != nil {
+			return f, fmt.Errorf("invalid regex for include: %w", err)
+		}
+	}
+	if iregex := c.String("iregex"); iregex != "" {
+		if f.IRegex, err = regexp.Compile(iregex); err != nil {
+			return f, fmt.Errorf("invalid regex for exclude: %w", err)
+		}
+	}
+	return f, nil
+}
+
+// extractToTar writes the entries of archive to stdout as an uncompressed tar
+// stream, so formats tar can't read can still be fed to it. Each entry is
+// written as it's read, keeping its metadata.
+func extractToTar(ctx context.Context, c *cli.Command, archive string) error {
+	if archive == "" {
+		return errors.New("archive path is required")
+	}
+	if isTTY(c, os.Stdout) {
+		return errors.New("refusing to write a tar stream to a terminal")
+	}
+	if archive == "-" && c.Bool("verify-sig") {
+		return errors.New("--verify-sig can't check an archive read from stdin")
+	}
+	if err := verifySignature(c, archive); err != nil {
+		return err
+	}
+	f, name, err := xpld.OpenArchive(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	format, input, err := xpld.Identify(ctx, name, f, c.String("format"))
+	if err != nil {
+		return err
+	}
+	if format, err = xpld.WithPassword(format, passwordFunc(c)); err != nil {
+		return err
+	}
+	extractor, err := xpld.ArchiveExtractor(archive, format)
+	if err != nil {
+		return err
+	}
+	// The same entries are written as extract would write to a directory
+	filter, err := entryFilter(c)
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	err = archiveEntries(ctx, extractor, input, archives.Tar{}, out, func(fi *archives.FileInfo) (bool, error) {
+		// Directories --pattern only wants for the files beneath them are
+		// left to tar, which creates a file's parents when extracting it
+		ok, deferred := filter.Match(*fi)
+		return ok && !deferred, nil
+	})
+	if err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// extensionAliases maps the short extensions some tools use for compressed
+// tarballs to the names of the formats they stand for.
+var extensionAliases = map[string]string{
+	".tgz": "tar.gz", ".taz": "tar.gz", ".tbz": "tar.bz2", ".tbz2": "tar.bz2", ".tb2": "tar.bz2",
+	".txz": "tar.xz", ".tzst": "tar.zst", ".tlz": "tar.lz", ".tlz4": "tar.lz4", ".tbr": "tar.br",
+}
+
+// suggestFormat returns the name of the creatable format that the extension
+// of path most likely meant, such as tar.gz for .tgz or zip for .zp, or ""
+// if none is close.
+func suggestFormat(path string) string {
+	if alias, ok := extensionAliases[strings.ToLower(filepath.Ext(path))]; ok {
+		return alias
+	}
+	ext := strings.TrimPrefix(strings.ToLower(xpld.ArchiveExt(path)), ".")
+	if ext == "" {
+		return ""
+	}
+	best, bestDist := "", 3
+	for _, f := range knownFormats {
+		info := describeFormat(f)
+		if !info.Create {
+			continue
+		}
+		if d := editDistance(ext, info.Name); d < bestDist {
+			best, bestDist = info.Name, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// passwordFunc returns how to get the password given with --password or
+// --password-file, or nil if neither is set.
+func passwordFunc(c *cli.Command) func() (string, error) {
+	if !c.IsSet("password") && !c.IsSet("password-file") {
+		return nil
+	}
+	return func() (string, error) { return readPassword(c) }
+}
+
+// readPassword returns the password from --password-file or --password, or
+// prompts for it on the terminal when --password is given empty, so that it
+// doesn't show up in the process list.
+func readPassword(c *cli.Command) (string, error) {
+	if path := c.String("password-file"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	if password := c.String("password"); password != "" {
+		return password, nil
+	}
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", errors.New("no terminal to prompt for the password on, use --password-file")
+	}
+	defer tty.Close()
+	stty := func(arg string) {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = tty
+		cmd.Run()
+	}
+	fmt.Fprint(tty, "Password: ")
+	stty("-echo")
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	stty("echo")
+	fmt.Fprintln(tty)
+	if err != nil && line == "" {
+		return "", fmt.Errorf("reading password: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// geteuid returns the effective user ID extraction runs as. It is a variable
+// so that tests can extract as root or not, whoever runs them.
+var geteuid = os.Geteuid
+
+// restoreOwnership reports whether extracted files should be given the
+// ownership stored in the archive. Like tar, unprivileged users keep their
+// own ownership unless --same-owner is given, since they can't chown files
+// to others anyway.
+func restoreOwnership(c *cli.Command) bool {
+	if c.Bool("owner-from-current") {
+		return false
+	}
+	if geteuid() != 0 && !c.Bool("same-owner") {
+		return false
+	}
+	return c.Bool("preserve-ownership") || c.Bool("uid-ownership")
+}
+
+// newArchiver returns the archiver for format, configured by the
+// --store-compressed-types and --level flags.
+func newArchiver(c *cli.Command, format archives.Format) (archives.Archiver, error) {
+	var level *int
+	if c.IsSet("level") {
+		l := c.Int("level")
+		level = &l
+	}
+	return xpld.NewArchiver(format, level, c.Bool("store-compressed-types"), warn)
+}
+
+type fileEntry struct{ name string; info fs.FileInfo; kind, checksum string }
+
+// treeFS adapts an fs.FS for the tree renderer, leaving out special files
+// under --skip-special. When sort is set, each listing is ordered by
+// sortFiles, for sort keys tree can't apply itself.
+type treeFS struct {
+	fsys fs.FS
+	c    *cli.Command
+	sort bool
+}
+
+func (tfs treeFS) ReadDir(dirname string) ([]string, error) {
+	entries, err := fs.ReadDir(tfs.fsys, dirname)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]fileEntry, 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		if tfs.c.Bool("skip-special") && xpld.SpecialType(info.Mode()) != "" {
+			continue
+		}
+		files = append(files, fileEntry{name: e.Name(), info: info})
+	}
+	if tfs.sort {
+		if err := sortFiles(tfs.c, files); err != nil {
+			return nil, err
+		}
+	}
+	names := make([]string, len(files))
+	for i, f := range files {
+		name := f.name
+		if f.info.IsDir() && !strings.HasSuffix(name, "/") {
+			name += "/"
+		}
+		names[i] = name
+	}
+	return names, nil
+}
+func (tfs treeFS) Stat(name string) (os.FileInfo, error) {
+	f, err := tfs.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// convertArchive rewrites the archive at src in the format dst's name calls
+// for. Entries are read one at a time from the source archive as they are
+// written, keeping their names, modes, times, ownership and link targets.
+func convertArchive(ctx context.Context, c *cli.Command, src, dst string) (err error) {
+	if src == "" || dst == "" {
+		return errors.New("archive path and output file are required")
+	}
+	if srcInfo, err := os.Stat(src); err != nil {
+		return err
+	} else if dstInfo, err := os.Stat(dst); err == nil && os.SameFile(srcInfo, dstInfo) {
+		return fmt.Errorf("refusing to convert %s onto itself", src)
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	srcFormat, input, err := archives.Identify(ctx, src, f)
+	if err != nil {
+		return xpld.IdentifyError(src, err)
+	}
+	extractor, err := xpld.ArchiveExtractor(src, srcFormat)
+	if err != nil {
+		return err
+	}
+	format, _, err := archives.Identify(ctx, dst, nil)
+	if err != nil {
+		return err
+	}
+	archiver, err := newArchiver(c, format)
+	if err != nil {
+		return err
+	}
+	async, ok := archiver.(archives.ArchiverAsync)
+	if !ok {
+		return fmt.Errorf("%s archives can't be written as a stream", format.Extension())
+	}
+
+	outFile, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	// Don't leave half an archive behind
+	defer func() {
+		if cerr := outFile.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(dst)
+		}
+	}()
+	out := bufio.NewWriter(outFile)
+	vlog := newVerboseLog(c)
+	err = archiveEntries(ctx, extractor, input, async, out, func(fi *archives.FileInfo) (bool, error) {
+		fi.NameInArchive = xpld.ArchiveName(fi.NameInArchive, fi)
+		vlog.log(fi.NameInArchive)
+		return true, nil
+	})
+	vlog.done()
+	if err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// archiveEntries writes each entry extractor reads from input to out with
+// archiver as soon as it's read, so an archive is repacked in a single pass
+// without holding it in memory or reopening its entries. If each isn't nil,
+// it is called with every entry first, and may rename it or leave it out by
+// returning false.
+func archiveEntries(ctx context.Context, extractor archives.Extractor, input io.Reader, archiver archives.ArchiverAsync, out io.Writer, each func(*archives.FileInfo) (bool, error)) error {
+	jobs := make(chan archives.ArchiveAsyncJob)
+	done := make(chan error, 1)
+	go func() { done <- archiver.ArchiveAsync(ctx, out, jobs) }()
+	result := make(chan error)
+	// The archiver may give up before taking every job, such as when its
+	// compressor can't be set up
+	var archiveErr error
+	stopped := false
+	err := extractor.Extract(ctx, input, func(ctx context.Context, fi archives.FileInfo) error {
+		if each != nil {
+			if ok, err := each(&fi); err != nil || !ok {
+				return err
+			}
+		}
+		select {
+		case jobs <- archives.ArchiveAsyncJob{File: fi, Result: result}:
+			return <-result
+		case archiveErr = <-done:
+			stopped = true
+			if archiveErr == nil {
+				archiveErr = errors.New("archive writer stopped early")
+			}
+			return archiveErr
+		}
+	})
+	close(jobs)
+	if !stopped {
+		archiveErr = <-done
+	}
+	if err == nil {
+		err = archiveErr
+	}
+	return err
+}
+
+// addToArchive adds srcs to archive, named as create would name them. Tar
+// and zip archives are appended to in place; other formats, such as
+// compressed tarballs, have to be rewritten in full. Entries that are
+// already in the archive are only replaced with --replace.
+func addToArchive(ctx context.Context, c *cli.Command, archive string, srcs []string) error {
+	if archive == "" || len(srcs) == 0 {
+		return errors.New("archive path and sources are required")
+	}
+	var added []archives.FileInfo
+	for _, src := range srcs {
+		files, err := archives.FilesFromDisk(ctx, nil, map[string]string{src: ""})
+		if err != nil {
+			return err
+		}
+		for i := range files {
+			files[i].NameInArchive = xpld.ArchiveName(files[i].NameInArchive, files[i])
+		}
+		added = append(added, files...)
+	}
+
+	fsys, err := archives.FileSystem(ctx, archive, nil)
+	if err != nil {
+		return err
+	}
+	if _, ok := fsys.(*archives.ArchiveFS); !ok {
+		return fmt.Errorf("%s is not an archive", archive)
+	}
+	existing := map[string]bool{}
+	err = fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		existing[path] = d.IsDir()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	replaced := map[string]bool{}
+	var inputs []archives.FileInfo
+	for _, f := range added {
+		name := strings.TrimSuffix(f.NameInArchive, "/")
+		isDir, ok := existing[name]
+		switch {
+		case !ok:
+		case isDir && f.IsDir():
+			// The directory is already there; only its contents are new
+			continue
+		case !c.Bool("replace"):
+			return fmt.Errorf("%s is already in %s, use --replace to replace it", name, archive)
+		default:
+			replaced[name] = true
+		}
+		inputs = append(inputs, f)
+	}
+
+	f, err := os.OpenFile(archive, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	format, _, err := archives.Identify(ctx, archive, f)
+	if err != nil {
+		return err
+	}
+	archiver, err := newArchiver(c, format)
+	if err != nil {
+		return err
+	}
+	// Zip replaces entries it inserts over, but appending to a tar
+	// would leave the old entries in place
+	switch inserter := archiver.(type) {
+	case archives.Zip:
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return insertZip(ctx, inserter, f, inputs)
+	case archives.Tar:
+		if len(replaced) == 0 {
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			return insertTar(ctx, inserter, f, inputs)
+		}
+		fmt.Fprintf(os.Stderr, "xpld: replacing entries of %s means rewriting it\n", archive)
+	default:
+		fmt.Fprintf(os.Stderr, "xpld: %s archives can't be appended to in place, rewriting %s\n", format.Extension(), archive)
+	}
+
+	var kept []archives.FileInfo
+	err = fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == "." {
+			return nil
+		}
+		if replaced[path] {
+			if d.IsDir() {
 				return fs.SkipDir
 			}
 			return nil
 		}
-		info, err := d.Info()
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		kept = append(kept, archives.FileInfo{
+			NameInArchive: xpld.ArchiveName(path, info),
+			FileInfo:      info,
+			LinkTarget:    xpld.LinkTarget(info),
+			Open: func() (fs.File, error) {
+				if !info.Mode().IsRegular() {
+					return xpld.NoContent(info), nil
+				}
+				return fsys.Open(path)
+			},
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Write next to the archive and rename over it, so a failure part way
+	// through leaves the original untouched
+	tmp, err := os.CreateTemp(filepath.Dir(archive), ".xpld-add-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if err := archiver.Archive(ctx, tmp, append(kept, inputs...)); err != nil {
+		return err
+	}
+	if info, err := f.Stat(); err == nil {
+		if err := tmp.Chmod(info.Mode()); err != nil {
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), archive)
+}
+
+// insertZip inserts files into the zip archive f. mholt/archives stops
+// inserting at the first directory it's given, so directories are each
+// inserted on their own after the files.
+func insertZip(ctx context.Context, z archives.Zip, f *os.File, files []archives.FileInfo) error {
+	var regular []archives.FileInfo
+	var dirs []archives.FileInfo
+	for _, file := range files {
+		if file.IsDir() {
+			dirs = append(dirs, file)
+		} else {
+			regular = append(regular, file)
+		}
+	}
+	if err := z.Insert(ctx, f, regular); err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := z.Insert(ctx, f, []archives.FileInfo{dir}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertTar appends files to the tar archive f. mholt/archives rounds the
+// end of the last entry up a whole block when it's already block-aligned, as
+// it is after a directory, leaving a zero block that ends the archive early
+// for readers. This finds the end of the last entry itself and writes the
+// new entries and end-of-archive marker from there.
+func insertTar(ctx context.Context, t archives.Tar, f *os.File, files []archives.FileInfo) error {
+	const blockSize = 512
+	var end int64
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		pos, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		// tar.Reader reads headers a block at a time, so pos is where this
+		// entry's data starts
+		end = pos + (hdr.Size+blockSize-1)/blockSize*blockSize
+	}
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		return err
+	}
+	if err := t.Archive(ctx, f, files); err != nil {
+		return err
+	}
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	return f.Truncate(pos)
+}
+
+// knownFormats are the formats mholt/archives registers. Its registry isn't
+// exported, so this list has to be kept in step with it. Compression formats
+// are used to compress tarballs.
+var knownFormats = []archives.Format{
+	archives.Tar{}, archives.Zip{}, archives.SevenZip{}, archives.Rar{},
+	archives.Gz{}, archives.Bz2{}, archives.Xz{}, archives.Zstd{}, archives.Brotli{},
+	archives.Lz4{}, archives.Lzip{}, archives.Sz{}, archives.MinLZ{}, archives.Zlib{},
+}
+
+// multithreadedFormats compress or decompress on several cores as xpld
+// configures them.
+var multithreadedFormats = map[string]bool{".zst": true, ".sz": true}
+
+type formatInfo struct {
+	Name        string   `json:"name"`
+	Extensions  []string `json:"extensions"`
+	Create      bool     `json:"create"`
+	Extract     bool     `json:"extract"`
+	Inspect     bool     `json:"inspect"`
+	Append      bool     `json:"append"`
+	Encryption  bool     `json:"encryption"`
+	Multithread bool     `json:"multithread"`
+}
+
+// describeFormat works out what xpld can do with format from the interfaces
+// it implements. Appending means appending in place, which `add` falls back
+// to rewriting the archive for. Encryption means extracting encrypted
+// archives with --password; no format can be written encrypted.
+func describeFormat(format archives.Format) formatInfo {
+	if comp, ok := format.(archives.Compression); ok {
+		format = archives.CompressedArchive{Archival: archives.Tar{}, Extraction: archives.Tar{}, Compression: comp}
+	}
+	ext := format.Extension()
+	_, create := format.(archives.Archiver)
+	_, extract := format.(archives.Extractor)
+	_, inserter := format.(archives.Inserter)
+	var encryption bool
+	switch format.(type) {
+	case archives.SevenZip, archives.Rar:
+		encryption = true
+	}
+	return formatInfo{
+		Name:        strings.TrimPrefix(ext, "."),
+		Extensions:  []string{ext},
+		Create:      create,
+		Extract:     extract,
+		Inspect:     extract,
+		Append:      inserter,
+		Encryption:  encryption,
+		Multithread: multithreadedFormats[filepath.Ext(ext)],
+	}
+}
+
+func listFormats(ctx context.Context, c *cli.Command) error {
+	infos := make([]formatInfo, len(knownFormats))
+	for i, format := range knownFormats {
+		infos[i] = describeFormat(format)
+	}
+	if c.Bool("json") {
+		b, err := json.MarshalIndent(infos, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+	yesNo := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return "no"
+	}
+	if c.Bool("detailed") {
+		fmt.Printf("%-10s %-8s %-8s %-8s %-8s %-11s %s\n", "FORMAT", "CREATE", "EXTRACT", "INSPECT", "APPEND", "ENCRYPTION", "MULTITHREAD")
+		for _, f := range infos {
+			fmt.Printf("%-10s %-8s %-8s %-8s %-8s %-11s %s\n", f.Name, yesNo(f.Create), yesNo(f.Extract), yesNo(f.Inspect), yesNo(f.Append), yesNo(f.Encryption), yesNo(f.Multithread))
+		}
+		return nil
+	}
+	for _, f := range infos {
+		var ops []string
+		if f.Create {
+			ops = append(ops, "create")
+		}
+		if f.Extract {
+			ops = append(ops, "extract")
+		}
+		fmt.Printf("%-10s %s\n", strings.Join(f.Extensions, ", "), strings.Join(ops, ", "))
+	}
+	return nil
+}
+
+type verifyFailure struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+type verifyResult struct {
+	Files   int64           `json:"files"`
+	Bytes   int64           `json:"bytes"`
+	Failed  []verifyFailure `json:"failed"`
+	Entries []string        `json:"entries,omitempty"`
+}
+
+// verifyArchive reads and decompresses every file in the archive without
+// writing anything, reporting entries that can't be read back. For zip
+// entries, the CRC32 of what was read is also checked against the stored one.
+func verifyArchive(ctx context.Context, c *cli.Command) error {
+	archive := c.Args().First()
+	if archive == "" {
+		return errors.New("archive path is required")
+	}
+	if err := verifySignature(c, archive); err != nil {
+		return err
+	}
+	result := verifyResult{Failed: []verifyFailure{}}
+	fail := func(name string, err error) {
+		result.Failed = append(result.Failed, verifyFailure{name, err.Error()})
+		if !c.Bool("json") {
+			fmt.Printf("FAILED %s: %v\n", name, err)
+		}
+	}
+	err := xpld.ReadEntries(ctx, archive, func(name string, info fs.FileInfo, r io.Reader) error {
+		result.Files++
+		h := crc32.NewIEEE()
+		n, err := io.Copy(io.MultiWriter(io.Discard, h), r)
+		result.Bytes += n
+		if zh, ok := info.Sys().(*zip.FileHeader); ok && (err == nil || errors.Is(err, zip.ErrChecksum)) {
+			if sum := h.Sum32(); sum != zh.CRC32 {
+				err = fmt.Errorf("crc mismatch: stored %08x, computed %08x", zh.CRC32, sum)
+			}
+		}
+		if err != nil {
+			fail(name, err)
+			return nil
+		}
+		if c.Bool("summary-only") {
+			return nil
+		}
+		if c.Bool("json") {
+			result.Entries = append(result.Entries, name)
+		} else {
+			fmt.Printf("ok     %s\n", name)
+		}
+		return nil
+	})
+	readErr := err
+	if readErr != nil {
+		// The archive itself couldn't be read any further
+		fail(archive, readErr)
+	}
+	if c.Bool("json") {
+		b, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+	} else if len(result.Failed) == 0 {
+		fmt.Printf("OK: %d files, %d bytes\n", result.Files, result.Bytes)
+	}
+	if readErr != nil {
+		return fmt.Errorf("%s is unreadable after %d files: %w", archive, result.Files, readErr)
+	}
+	if len(result.Failed) > 0 {
+		return fmt.Errorf("%d of %d files failed verification", len(result.Failed), result.Files)
+	}
+	return nil
+}
+
+// manifestArchive prints a digest of each file in the archive in the format
+// of sha256sum and friends, or with --check, verifies the archive against
+// such a manifest.
+func manifestArchive(ctx context.Context, c *cli.Command) error {
+	archive := c.Args().First()
+	if archive == "" {
+		return errors.New("archive path is required")
+	}
+	if c.String("check") != "" && c.IsSet("output") {
+		return errors.New("--check and --output can't be combined")
+	}
+	if xpld.NewChecksum(c.String("algo")) == nil {
+		return fmt.Errorf("invalid algorithm %q, must be md5, sha1, sha256 or crc32", c.String("algo"))
+	}
+	if err := verifySignature(c, archive); err != nil {
+		return err
+	}
+	if path := c.String("check"); path != "" {
+		return checkManifest(ctx, c, archive, path)
+	}
+
+	out := os.Stdout
+	if path := c.String("output"); path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+	err := xpld.ReadEntries(ctx, archive, func(name string, info fs.FileInfo, r io.Reader) error {
+		h := xpld.NewChecksum(c.String("algo"))
+		if _, err := io.Copy(h, r); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		// Like sha256sum, names with a newline or backslash are escaped and
+		// the line is marked with a leading backslash
+		prefix := ""
+		if strings.ContainsAny(name, "\\\n") {
+			prefix = "\\"
+			name = strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(name)
+		}
+		_, err := fmt.Fprintf(w, "%s%x  %s\n", prefix, h.Sum(nil), name)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// checkManifest verifies the files in archive against the given manifest,
+// printing each one that is missing or has a different digest. The digest
+// algorithm is taken from --algo if given, or else from the digests' length.
+func checkManifest(ctx context.Context, c *cli.Command, archive, manifest string) error {
+	data, err := os.ReadFile(manifest)
+	if err != nil {
+		return err
+	}
+	want := map[string]string{}
+	var names []string
+	algo := ""
+	for i, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		escaped := strings.HasPrefix(line, "\\")
+		line = strings.TrimPrefix(line, "\\")
+		sum, name, ok := strings.Cut(line, " ")
+		if !ok || len(name) == 0 || (name[0] != ' ' && name[0] != '*') {
+			return fmt.Errorf("%s:%d: not a checksum line", manifest, i+1)
+		}
+		name = name[1:]
+		if escaped {
+			name = strings.NewReplacer("\\\\", "\\", "\\n", "\n").Replace(name)
+		}
+		if algo == "" {
+			if algo = c.String("algo"); !c.IsSet("algo") {
+				algo = map[int]string{8: "crc32", 32: "md5", 40: "sha1", 64: "sha256"}[len(sum)]
+			}
+		}
+		if h := xpld.NewChecksum(algo); h == nil || len(sum) != 2*h.Size() {
+			return fmt.Errorf("%s:%d: not a checksum line", manifest, i+1)
+		}
+		name = path.Clean(name)
+		if _, dup := want[name]; !dup {
+			names = append(names, name)
+		}
+		want[name] = strings.ToLower(sum)
+	}
+
+	got := map[string]string{}
+	err = xpld.ReadEntries(ctx, archive, func(name string, info fs.FileInfo, r io.Reader) error {
+		if _, ok := want[name]; !ok {
+			return nil
+		}
+		h := xpld.NewChecksum(algo)
+		if _, err := io.Copy(h, r); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		got[name] = hex.EncodeToString(h.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	var failed, missing int
+	for _, name := range names {
+		switch sum, ok := got[name]; {
+		case !ok:
+			missing++
+			fmt.Printf("%s: MISSING\n", name)
+		case sum != want[name]:
+			failed++
+			fmt.Printf("%s: FAILED\n", name)
+		}
+	}
+	if failed > 0 || missing > 0 {
+		return fmt.Errorf("%d of %d files failed the check, %d missing", failed, len(names), missing)
+	}
+	fmt.Printf("OK: %d files\n", len(names))
+	return nil
+}
+
+// catArchive writes the contents of the named entries to stdout, in the order
+// given. Names may be glob patterns, which only select regular files unless
+// --include-all is set.
+func catArchive(ctx context.Context, c *cli.Command) error {
+	args := c.Args().Slice()
+	if len(args) < 2 {
+		return errors.New("archive path and at least one entry are required")
+	}
+	archive, names := args[0], args[1:]
+	if c.IsSet("head") && c.IsSet("tail") {
+		return errors.New("--head and --tail can't be combined")
+	}
+	limit := int64(-1)
+	if s := c.String("limit"); s != "" {
+		n, err := xpld.ParseBytes(s, unitBase(c))
+		if err != nil {
+			return fmt.Errorf("invalid limit: %w", err)
+		}
+		limit = n
+	}
+	if err := verifySignature(c, archive); err != nil {
+		return err
+	}
+	fsys, err := archives.FileSystem(ctx, archive, nil)
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	for _, name := range names {
+		if !strings.ContainsAny(name, "*?[") {
+			info, err := fs.Stat(fsys, name)
+			if errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("%s: no such entry in %s", name, archive)
+			}
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return fmt.Errorf("%s is a directory", name)
+			}
+			if !info.Mode().IsRegular() && !c.Bool("include-all") {
+				return fmt.Errorf("%s is not a regular file", name)
+			}
+			if err := catEntry(c, out, fsys, name, info, limit); err != nil {
+				return err
+			}
+			continue
+		}
+		matches, err := fs.Glob(fsys, name)
+		if err != nil {
+			return err
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("%s: no entries match in %s", name, archive)
+		}
+		for _, match := range matches {
+			info, err := fs.Stat(fsys, match)
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || !info.Mode().IsRegular() && !c.Bool("include-all") {
+				continue
+			}
+			if err := catEntry(c, out, fsys, match, info, limit); err != nil {
+				return err
+			}
+		}
+	}
+	return out.Flush()
+}
+
+// catEntry writes one entry for catArchive. Symlinks are written as their
+// target, and other non-regular files as nothing.
+func catEntry(c *cli.Command, w io.Writer, fsys fs.FS, name string, info fs.FileInfo, limit int64) error {
+	if !info.Mode().IsRegular() {
+		_, err := io.WriteString(w, xpld.LinkTarget(info))
+		return err
+	}
+	f, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if limit >= 0 {
+		r = io.LimitReader(r, limit)
+	}
+	switch {
+	case c.IsSet("head"):
+		br := bufio.NewReader(r)
+		for i := 0; i < c.Int("head"); i++ {
+			line, err := br.ReadString('\n')
+			if _, werr := io.WriteString(w, line); werr != nil {
+				return werr
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case c.IsSet("tail"):
+		n := c.Int("tail")
+		if n <= 0 {
+			return nil
+		}
+		lines := make([]string, 0, n)
+		br := bufio.NewReader(r)
+		for {
+			line, err := br.ReadString('\n')
+			if line != "" {
+				if len(lines) == n {
+					lines = lines[1:]
+				}
+				lines = append(lines, line)
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		_, err := io.WriteString(w, strings.Join(lines, ""))
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// grepArchive prints each line of the archive's files matching a regular
+// expression as path:lineno:line, reading the archive in a single pass.
+// Files that look binary are skipped unless --binary text is given.
+func grepArchive(ctx context.Context, c *cli.Command) error {
+	args := c.Args().Slice()
+	expr := c.String("regexp")
+	if !c.IsSet("regexp") {
+		if len(args) == 0 {
+			return errors.New("regular expression is required")
+		}
+		expr, args = args[0], args[1:]
+	}
+	if len(args) != 1 {
+		return errors.New("archive path is required")
+	}
+	archive := args[0]
+	if anchor := c.String("anchor"); anchor != "basename" && anchor != "fullpath" {
+		return fmt.Errorf("invalid anchor %q, must be basename or fullpath", anchor)
+	}
+	if mode := c.String("binary"); mode != "skip" && mode != "text" {
+		return fmt.Errorf("invalid --binary %q, must be skip or text", mode)
+	}
+	if c.Bool("ignore-case") {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return fmt.Errorf("invalid regular expression: %w", err)
+	}
+	if err := verifySignature(c, archive); err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	err = xpld.ReadEntries(ctx, archive, func(name string, info fs.FileInfo, r io.Reader) error {
+		if p := c.String("pattern"); p != "" && !matchPattern(c, p, name) {
+			return nil
+		}
+		if p := c.String("ipattern"); p != "" && matchPattern(c, p, name) {
+			return nil
+		}
+		// Sized so that the Peek below sees all that xpld.ClassifyContent reads
+		br := bufio.NewReaderSize(r, 8000)
+		if c.String("binary") == "skip" {
+			head, err := br.Peek(8000)
+			if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			if kind, _ := xpld.ClassifyContent(bytes.NewReader(head)); kind == "binary" {
+				return nil
+			}
+		}
+		sc := bufio.NewScanner(br)
+		sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for lineno := 1; sc.Scan(); lineno++ {
+			if !re.Match(sc.Bytes()) {
+				continue
+			}
+			if c.Bool("files-with-matches") {
+				_, err := fmt.Fprintln(w, name)
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "%s:%d:%s\n", name, lineno, sc.Bytes()); err != nil {
+				return err
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// completeEntries completes the entry arguments of commands taking an
+// archive followed by entry names, by listing the archive given first. At
+// most maxEntries entries are completed, or any number if it is 0. Nothing
+// is printed if the archive can't be read in time, so the shell falls back
+// to its own completion.
+func completeEntries(maxEntries int, regularOnly bool) cli.ShellCompleteFunc {
+	return func(ctx context.Context, c *cli.Command) {
+		args := c.Args().Slice()
+		if len(args) == 0 || strings.HasPrefix(args[len(args)-1], "-") || maxEntries > 0 && len(args) > maxEntries {
+			cli.DefaultCompleteWithFlags(ctx, c)
+			return
+		}
+		ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		fsys, err := archives.FileSystem(ctx, args[0], nil)
 		if err != nil {
+			return
+		}
+		w := bufio.NewWriter(c.Root().Writer)
+		defer w.Flush()
+		fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if path == "." || regularOnly && !d.Type().IsRegular() {
+				return nil
+			}
+			_, err = fmt.Fprintln(w, path)
 			return err
+		})
+	}
+}
+
+// statFields are the metadata statEntry prints, in order, when the archive
+// records them.
+var statFields = []string{"name", "size", "mode", "type", "mtime", "ctime", "atime", "uid", "user", "gid", "group", "inode", "device", "symlink_target"}
+
+func statEntry(ctx context.Context, c *cli.Command) error {
+	if c.Args().Len() != 2 {
+		return errors.New("usage: xpld stat <archive> <entry>")
+	}
+	archive := c.Args().Get(0)
+	name := path.Clean(strings.TrimPrefix(c.Args().Get(1), "/"))
+	if err := verifySignature(c, archive); err != nil {
+		return err
+	}
+	fsys, err := archives.FileSystem(ctx, archive, nil)
+	if err != nil {
+		return err
+	}
+	info, err := statArchiveEntry(fsys, name)
+	// Resolve chains of symlinks, giving up on loops the way the kernel does
+	for hops := 0; err == nil && c.Bool("follow-links") && info.Mode()&fs.ModeSymlink != 0; hops++ {
+		target := xpld.LinkTarget(info)
+		if target == "" {
+			return fmt.Errorf("%s: can't follow symlink, the archive doesn't record its target", name)
 		}
-		name := path
-		if d.IsDir() && !strings.HasSuffix(name, "/") {
-			name += "/"
+		if hops == 40 {
+			return fmt.Errorf("%s: too many levels of symlinks", c.Args().Get(1))
+		}
+		if path.IsAbs(target) {
+			name = path.Clean(target[1:])
+		} else {
+			name = path.Join(path.Dir(name), target)
+		}
+		if !fs.ValidPath(name) {
+			return fmt.Errorf("%s: symlink points outside the archive", c.Args().Get(1))
 		}
-		if c.Bool("full-path") {
-			name = filepath.Join(c.Args().First(), name)
+		info, err = statArchiveEntry(fsys, name)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%s: no such entry in %s", name, archive)
+	}
+	if err != nil {
+		return err
+	}
+
+	f := fileEntry{name: name, info: info}
+	if c.Bool("json") {
+		entry := map[string]interface{}{}
+		for _, field := range statFields {
+			if v, ok := jsonFields[field](c, f); ok {
+				entry[field] = v
+			}
 		}
-		if c.Bool("quotes") {
-			name = fmt.Sprintf("%q", name)
+		b, err := json.MarshalIndent(entry, "", "  ")
+		if err != nil {
+			return err
 		}
-		files = append(files, fileEntry{name, info})
+		fmt.Println(string(b))
 		return nil
-	})
+	}
+	for _, field := range statFields {
+		v, ok := jsonFields[field](c, f)
+		if !ok {
+			continue
+		}
+		if t, isTime := v.(time.Time); isTime {
+			v = formatTime(c, t)
+		}
+		fmt.Printf("%s: %v\n", field, v)
+	}
+	return nil
+}
+
+// statArchiveEntry stats name in fsys by listing its parent directory.
+// Unlike fs.Stat, that yields the archives.FileInfo that records symlink
+// targets.
+func statArchiveEntry(fsys fs.FS, name string) (fs.FileInfo, error) {
+	if name == "." {
+		return fs.Stat(fsys, name)
+	}
+	entries, err := fs.ReadDir(fsys, path.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range entries {
+		if d.Name() == path.Base(name) {
+			return d.Info()
+		}
+	}
+	return nil, fs.ErrNotExist
+}
+
+func inspectArchive(ctx context.Context, c *cli.Command) error {
+	archive := c.Args().First()
+	if err := verifySignature(c, archive); err != nil {
+		return err
+	}
+	if anchor := c.String("anchor"); anchor != "basename" && anchor != "fullpath" {
+		return fmt.Errorf("invalid anchor %q, must be basename or fullpath", anchor)
+	}
+	opts := xpld.InspectOptions{
+		Archive:         archive,
+		Pattern:         c.String("pattern"),
+		IPattern:        c.String("ipattern"),
+		FullPath:        c.String("anchor") == "fullpath",
+		MatchDirs:       c.Bool("match-dirs"),
+		DirsOnly:        c.Bool("dirs-only"),
+		SkipSpecial:     c.Bool("skip-special"),
+		Depth:           c.Int("depth"),
+		Recursive:       c.Bool("recursive"),
+		MaxRecursion:    c.Int("max-recursion"),
+		ClassifyContent: c.Bool("classify-content"),
+		Checksum:        c.String("checksum"),
+		Warn:            warn,
+	}
+	for _, limit := range []struct {
+		flag string
+		size **int64
+	}{{"min-size", &opts.MinSize}, {"max-size", &opts.MaxSize}} {
+		if s := c.String(limit.flag); s != "" {
+			n, err := xpld.ParseBytes(s, unitBase(c))
+			if err != nil {
+				return fmt.Errorf("invalid --%s: %w", limit.flag, err)
+			}
+			*limit.size = &n
+		}
+	}
+	if _, err := timeLocation(c); err != nil {
+		return err
+	}
+	var formats int
+	for _, format := range []string{"json", "ndjson", "csv"} {
+		if c.Bool(format) {
+			formats++
+		}
+	}
+	if formats > 1 {
+		return errors.New("only one of --json, --ndjson and --csv can be given")
+	}
+	if c.Bool("tree") {
+		fsys, f, err := xpld.FileSystem(ctx, archive)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		defer startPager(c)()
+		return outputTree(c, fsys)
+	}
+	entry := func(e xpld.Entry) fileEntry {
+		f := fileEntry{e.Name, e.Info, e.Kind, e.Checksum}
+		if c.Bool("quotes") && !e.Nested {
+			f.name = fmt.Sprintf("%q", f.name)
+		}
+		return f
+	}
+
+	// Unsorted text and JSON-lines listings are printed as entries are
+	// found rather than collected first, keeping memory flat for huge
+	// archives
+	plain := !c.Bool("json") && !c.Bool("csv") && !c.Bool("porcelain") && !c.Bool("tar") && !c.Bool("long")
+	if noSort(c) && !c.Bool("reverse") && !c.Bool("top-dirs") && c.Int("top") == 0 && (plain || c.Bool("ndjson")) {
+		stream := &entryStream{c: c}
+		if c.Bool("ndjson") {
+			var err error
+			if stream.fields, err = parseFields(c); err != nil {
+				return err
+			}
+		}
+		defer startPager(c)()
+		opts.Each = func(e xpld.Entry) error { return stream.print(entry(e)) }
+		if _, err := xpld.Inspect(ctx, opts); err != nil {
+			return err
+		}
+		return stream.finish()
+	}
+
+	entries, err := xpld.Inspect(ctx, opts)
 	if err != nil {
 		return err
 	}
+	if c.Bool("top-dirs") {
+		return outputTopDirs(c, topDirs(entries))
+	}
+	files := make([]fileEntry, len(entries))
+	for i, e := range entries {
+		files[i] = entry(e)
+	}
 
 	// Sorting
-	sortFiles(c, files)
+	if err := sortFiles(c, files); err != nil {
+		return err
+	}
+
+	// The summary covers the whole listing, not just the --top entries
+	sum := summarize(files)
+	if n := c.Int("top"); n > 0 && n < len(files) {
+		files = files[:n]
+	}
 
 	// Output
+	defer startPager(c)()
 	switch {
 	case c.Bool("json"):
-		return outputJSON(c, files)
-	case c.Bool("tree"):
-		return outputTree(c, fsys)
+		return outputJSON(c, files, sum)
+	case c.Bool("ndjson"):
+		return outputNDJSON(c, files, sum)
+	case c.Bool("csv"):
+		return outputCSV(c, files)
+	case c.Bool("porcelain"):
+		return outputPorcelain(c, files)
+	case c.Bool("tar"):
+		return outputTar(c, files)
+	case c.Bool("long"):
+		return outputLong(c, files, sum)
 	default:
-		return outputText(c, files)
+		return outputText(c, files, sum)
 	}
 }
 
-func sortFiles(c *cli.Command, files []fileEntry) {
-	switch c.String("sort") {
-	case "size":
-		sort.Slice(files, func(i, j int) bool { return files[i].info.Size() < files[j].info.Size() })
-	case "mtime":
-		sort.Slice(files, func(i, j int) bool { return files[i].info.ModTime().Before(files[j].info.ModTime()) })
-	case "ctime":
-		sort.Slice(files, func(i, j int) bool {
-			if stat, ok := files[i].info.Sys().(interface{ Ctime() time.Time }); ok {
-				if stat2, ok := files[j].info.Sys().(interface{ Ctime() time.Time }); ok {
-					return stat.Ctime().Before(stat2.Ctime())
-				}
+// sortKeys are the keys --sort accepts, each comparing two entries.
+var sortKeys = map[string]func(c *cli.Command, a, b fileEntry) int{
+	"name": func(c *cli.Command, a, b fileEntry) int {
+		if c.Bool("ignore-case") {
+			return strings.Compare(strings.ToLower(a.name), strings.ToLower(b.name))
+		}
+		return strings.Compare(a.name, b.name)
+	},
+	"size": func(c *cli.Command, a, b fileEntry) int { return cmp.Compare(a.info.Size(), b.info.Size()) },
+	"mtime": func(c *cli.Command, a, b fileEntry) int {
+		return a.info.ModTime().Compare(b.info.ModTime())
+	},
+	"ctime": func(c *cli.Command, a, b fileEntry) int {
+		ta, _ := xpld.EntryTime(a.info, "ctime")
+		tb, _ := xpld.EntryTime(b.info, "ctime")
+		return ta.Compare(tb)
+	},
+	"atime": func(c *cli.Command, a, b fileEntry) int {
+		ta, _ := xpld.EntryTime(a.info, "atime")
+		tb, _ := xpld.EntryTime(b.info, "atime")
+		return ta.Compare(tb)
+	},
+	"extension": func(c *cli.Command, a, b fileEntry) int {
+		return strings.Compare(filepath.Ext(a.name), filepath.Ext(b.name))
+	},
+	"version": func(c *cli.Command, a, b fileEntry) int {
+		verA, verB := extractVersion(a.name), extractVersion(b.name)
+		switch {
+		case verA == verB:
+			return 0
+		case compareVersions(verA, verB):
+			return -1
+		case compareVersions(verB, verA):
+			return 1
+		}
+		return 0
+	},
+	"dirs-first": func(c *cli.Command, a, b fileEntry) int {
+		switch {
+		case a.info.IsDir() == b.info.IsDir():
+			return 0
+		case a.info.IsDir():
+			return -1
+		}
+		return 1
+	},
+}
+
+// parseSortKeys splits --sort into its keys, in order of precedence. A key
+// prefixed with "-" sorts in descending order. "time" stands for the
+// --time-field key.
+func parseSortKeys(c *cli.Command) ([]string, error) {
+	var keys []string
+	if c.Bool("dirs-first") {
+		keys = append(keys, "dirs-first")
+	}
+	for _, key := range strings.Split(c.String("sort"), ",") {
+		if key = strings.TrimSpace(key); key == "" {
+			continue
+		}
+		desc, name := strings.HasPrefix(key, "-"), strings.TrimPrefix(key, "-")
+		if name == "time" {
+			if name = c.String("time-field"); name != "mtime" && name != "ctime" && name != "atime" {
+				return nil, fmt.Errorf("invalid time field %q, must be mtime, ctime or atime", name)
 			}
-			return false
-		})
-	case "atime":
-		sort.Slice(files, func(i, j int) bool {
-			if stat, ok := files[i].info.Sys().(interface{ Atime() time.Time }); ok {
-				if stat2, ok := files[j].info.Sys().(interface{ Atime() time.Time }); ok {
-					return stat.Atime().Before(stat2.Atime())
-				}
+			if key = name; desc {
+				key = "-" + name
 			}
-			return false
-		})
-	case "extension":
-		sort.Slice(files, func(i, j int) bool {
-			extI := filepath.Ext(files[i].name)
-			extJ := filepath.Ext(files[j].name)
-			if extI == extJ {
-				return files[i].name < files[j].name
-			}
-			return extI < extJ
-		})
-	case "version":
-		sort.Slice(files, func(i, j int) bool {
-			verI := extractVersion(files[i].name)
-			verJ := extractVersion(files[j].name)
-			if verI == verJ {
-				return files[i].name < files[j].name
-			}
-			return compareVersions(verI, verJ)
-		})
-	default: // name
-		if c.Bool("ignore-case") {
-			sort.Slice(files, func(i, j int) bool { return strings.ToLower(files[i].name) < strings.ToLower(files[j].name) })
-		} else {
-			sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
 		}
+		if _, ok := sortKeys[name]; !ok {
+			return nil, fmt.Errorf("invalid sort key %q", key)
+		}
+		keys = append(keys, key)
 	}
-	if c.Bool("dirs-first") {
-		sort.SliceStable(files, func(i, j int) bool { return files[i].info.IsDir() && !files[j].info.IsDir() })
+	return keys, nil
+}
+
+// timeFallbackWarned records the time fields sortFiles has already warned
+// about falling back from, so each is only reported once.
+var timeFallbackWarned = map[string]bool{}
+
+// hasSortKey reports whether --sort includes key, in either direction.
+func hasSortKey(c *cli.Command, key string) bool {
+	for _, k := range strings.Split(c.String("sort"), ",") {
+		if strings.TrimPrefix(strings.TrimSpace(k), "-") == key {
+			return true
+		}
+	}
+	return false
+}
+
+// noSort reports whether entries should be listed in the order they are
+// found, with --no-sort or an empty --sort.
+func noSort(c *cli.Command) bool {
+	return c.Bool("no-sort") || c.String("sort") == "" && !c.Bool("dirs-first")
+}
+
+func sortFiles(c *cli.Command, files []fileEntry) error {
+	keys, err := parseSortKeys(c)
+	if err != nil {
+		return err
+	}
+	// Sorting by a time the archive doesn't record would leave the order
+	// looking random, so check once up front and use mtime instead
+	for i, key := range keys {
+		field := strings.TrimPrefix(key, "-")
+		if field != "atime" && field != "ctime" || len(files) == 0 || timeRecorded(files, field) {
+			continue
+		}
+		if !timeFallbackWarned[field] {
+			timeFallbackWarned[field] = true
+			fmt.Fprintf(os.Stderr, "xpld: this archive doesn't record %s, sorting by mtime instead\n", field)
+		}
+		keys[i] = strings.TrimSuffix(key, field) + "mtime"
+	}
+	if !noSort(c) {
+		sort.SliceStable(files, func(i, j int) bool {
+			for _, key := range keys {
+				r := sortKeys[strings.TrimPrefix(key, "-")](c, files[i], files[j])
+				if strings.HasPrefix(key, "-") {
+					r = -r
+				}
+				if r != 0 {
+					return r < 0
+				}
+			}
+			// Most formats store mtime at 1-second resolution, so ties are
+			// common; break them by name so the order is reproducible
+			return files[i].name < files[j].name
+		})
 	}
 	if c.Bool("reverse") {
 		for i, j := 0, len(files)-1; i < j; i, j = i+1, j-1 {
 			files[i], files[j] = files[j], files[i]
 		}
 	}
+	return nil
+}
+
+func outputJSON(c *cli.Command, files []fileEntry, sum inspectSummary) error {
+	fields, err := parseFields(c)
+	if err != nil {
+		return err
+	}
+	out := make([]interface{}, len(files))
+	for i, f := range files {
+		out[i] = jsonEntry(c, f, fields)
+	}
+	b, err := json.MarshalIndent(withSummary(c, sum, out), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(b))
+	endLine(c, 0, 1)
+	return nil
 }
 
-func outputJSON(c *cli.Command, files []fileEntry) error {
-	out := make([]map[string]interface{}, len(files))
+// outputNDJSON prints each entry as a JSON object on its own line, followed
+// by a {"summary": ...} line with --summary.
+func outputNDJSON(c *cli.Command, files []fileEntry, sum inspectSummary) error {
+	fields, err := parseFields(c)
+	if err != nil {
+		return err
+	}
+	lines := len(files)
+	if c.Bool("summary") {
+		lines++
+	}
 	for i, f := range files {
-		entry := map[string]interface{}{
-			"name": f.name,
-			"size": f.info.Size(),
-			"mode": f.info.Mode().String(),
-			"mtime": f.info.ModTime(),
+		b, err := json.Marshal(jsonEntry(c, f, fields))
+		if err != nil {
+			return err
 		}
-		if c.Bool("unit-size") {
-			entry["size"] = formatBytes(f.info.Size())
+		fmt.Print(string(b))
+		endLine(c, i, lines)
+	}
+	if c.Bool("summary") {
+		b, err := json.Marshal(map[string]interface{}{"summary": jsonSummary(c, sum)})
+		if err != nil {
+			return err
 		}
-		if stat, ok := f.info.Sys().(interface{ Uid() int; Gid() int }); ok {
-			if c.Bool("show-uid") {
-				entry["uid"] = stat.Uid()
-			}
-			if c.Bool("show-gid") {
-				entry["gid"] = stat.Gid()
+		fmt.Print(string(b))
+		endLine(c, lines-1, lines)
+	}
+	return nil
+}
+
+// jsonEntry builds the JSON object for f: the requested fields in order, or
+// the default set when fields is empty.
+func jsonEntry(c *cli.Command, f fileEntry, fields []string) interface{} {
+	if len(fields) > 0 {
+		var entry fieldEntry
+		for _, field := range fields {
+			if v, ok := jsonFields[field](c, f); ok {
+				entry = append(entry, fieldValue{field, v})
 			}
 		}
-		if c.Bool("last-mod") {
-			entry["mtime"] = f.info.ModTime()
-		}
-		if c.Bool("inodes") {
-			if stat, ok := f.info.Sys().(interface{ Ino() uint64 }); ok {
-				entry["inode"] = stat.Ino()
+		return entry
+	}
+	entry := map[string]interface{}{
+		"name": f.name,
+		"size": f.info.Size(),
+		"mode": f.info.Mode().String(),
+		"mtime": jsonTime(c, f.info.ModTime()),
+	}
+	if c.Bool("unit-size") {
+		entry["size"] = xpld.FormatBytes(f.info.Size(), unitBase(c))
+	}
+	if uid, gid, _, _, ok := xpld.Owner(f.info); ok {
+		user, group := ownerNames(c, f.info)
+		if c.Bool("show-uid") {
+			entry["uid"] = uid
+			if user != "" {
+				entry["user"] = user
 			}
 		}
-		if c.Bool("device") {
-			if stat, ok := f.info.Sys().(interface{ Dev() uint64 }); ok {
-				entry["device"] = stat.Dev()
+		if c.Bool("show-gid") {
+			entry["gid"] = gid
+			if group != "" {
+				entry["group"] = group
 			}
 		}
-		if c.Bool("ctime") {
-			if stat, ok := f.info.Sys().(interface{ Ctime() time.Time }); ok {
-				entry["ctime"] = stat.Ctime()
-			}
+	}
+	if c.Bool("last-mod") {
+		entry["mtime"] = jsonTime(c, f.info.ModTime())
+	}
+	if c.Bool("inodes") {
+		if stat, ok := f.info.Sys().(interface{ Ino() uint64 }); ok {
+			entry["inode"] = stat.Ino()
 		}
-		if c.Bool("atime") {
-			if stat, ok := f.info.Sys().(interface{ Atime() time.Time }); ok {
-				entry["atime"] = stat.Atime()
-			}
+	}
+	if c.Bool("device") {
+		if stat, ok := f.info.Sys().(interface{ Dev() uint64 }); ok {
+			entry["device"] = stat.Dev()
 		}
-		if c.String("sort") == "extension" {
-			entry["extension"] = filepath.Ext(f.name)
+	}
+	if c.Bool("ctime") {
+		if stat, ok := f.info.Sys().(interface{ Ctime() time.Time }); ok {
+			entry["ctime"] = jsonTime(c, stat.Ctime())
 		}
-		if c.String("sort") == "version" {
-			if ver := extractVersion(f.name); ver != "" {
-				entry["version"] = ver
-			}
+	}
+	if c.Bool("atime") {
+		if stat, ok := f.info.Sys().(interface{ Atime() time.Time }); ok {
+			entry["atime"] = jsonTime(c, stat.Atime())
+		}
+	}
+	if f.kind != "" {
+		entry["kind"] = f.kind
+	}
+	if algo := c.String("checksum"); algo != "" {
+		entry[algo] = f.checksum
+	}
+	if t := xpld.SpecialType(f.info.Mode()); t != "" {
+		entry["type"] = t
+	}
+	if f.info.Mode()&fs.ModeSymlink != 0 {
+		entry["symlink_target"] = xpld.LinkTarget(f.info)
+	}
+	if c.Bool("ratio") {
+		entry["ratio"] = "n/a"
+		if r, ok := compressionRatio(f.info); ok {
+			entry["ratio"] = r
+		}
+	}
+	if hasSortKey(c, "extension") {
+		entry["extension"] = filepath.Ext(f.name)
+	}
+	if hasSortKey(c, "version") {
+		if ver := extractVersion(f.name); ver != "" {
+			entry["version"] = ver
+		}
+	}
+	return entry
+}
+
+// timeRecorded reports whether any of files has field recorded.
+func timeRecorded(files []fileEntry, field string) bool {
+	for _, f := range files {
+		if _, ok := xpld.EntryTime(f.info, field); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonFields maps each field --fields can select to how it's read from an
+// entry. Fields that don't apply to an entry are left out of its object.
+var jsonFields = map[string]func(c *cli.Command, f fileEntry) (interface{}, bool){
+	"name": func(c *cli.Command, f fileEntry) (interface{}, bool) { return f.name, true },
+	"size": func(c *cli.Command, f fileEntry) (interface{}, bool) {
+		if c.Bool("unit-size") {
+			return xpld.FormatBytes(f.info.Size(), unitBase(c)), true
+		}
+		return f.info.Size(), true
+	},
+	"mode":  func(c *cli.Command, f fileEntry) (interface{}, bool) { return f.info.Mode().String(), true },
+	"mtime": func(c *cli.Command, f fileEntry) (interface{}, bool) { return jsonTime(c, f.info.ModTime()), true },
+	"uid": func(c *cli.Command, f fileEntry) (interface{}, bool) {
+		uid, _, _, _, ok := xpld.Owner(f.info)
+		return uid, ok
+	},
+	"gid": func(c *cli.Command, f fileEntry) (interface{}, bool) {
+		_, gid, _, _, ok := xpld.Owner(f.info)
+		return gid, ok
+	},
+	"user": func(c *cli.Command, f fileEntry) (interface{}, bool) {
+		user, _ := ownerNames(c, f.info)
+		return user, user != ""
+	},
+	"group": func(c *cli.Command, f fileEntry) (interface{}, bool) {
+		_, group := ownerNames(c, f.info)
+		return group, group != ""
+	},
+	"inode": func(c *cli.Command, f fileEntry) (interface{}, bool) {
+		stat, ok := f.info.Sys().(interface{ Ino() uint64 })
+		if !ok {
+			return nil, false
+		}
+		return stat.Ino(), true
+	},
+	"device": func(c *cli.Command, f fileEntry) (interface{}, bool) {
+		stat, ok := f.info.Sys().(interface{ Dev() uint64 })
+		if !ok {
+			return nil, false
+		}
+		return stat.Dev(), true
+	},
+	"ctime": func(c *cli.Command, f fileEntry) (interface{}, bool) {
+		stat, ok := f.info.Sys().(interface{ Ctime() time.Time })
+		if !ok {
+			return nil, false
+		}
+		return jsonTime(c, stat.Ctime()), true
+	},
+	"atime": func(c *cli.Command, f fileEntry) (interface{}, bool) {
+		stat, ok := f.info.Sys().(interface{ Atime() time.Time })
+		if !ok {
+			return nil, false
+		}
+		return jsonTime(c, stat.Atime()), true
+	},
+	"kind": func(c *cli.Command, f fileEntry) (interface{}, bool) { return f.kind, f.kind != "" },
+	"symlink_target": func(c *cli.Command, f fileEntry) (interface{}, bool) {
+		return xpld.LinkTarget(f.info), f.info.Mode()&fs.ModeSymlink != 0
+	},
+	"md5":    checksumField("md5"),
+	"sha1":   checksumField("sha1"),
+	"sha256": checksumField("sha256"),
+	"crc32":  checksumField("crc32"),
+	"ratio": func(c *cli.Command, f fileEntry) (interface{}, bool) {
+		if r, ok := compressionRatio(f.info); ok {
+			return r, true
 		}
-		out[i] = entry
+		return "n/a", true
+	},
+	"type": func(c *cli.Command, f fileEntry) (interface{}, bool) {
+		t := xpld.SpecialType(f.info.Mode())
+		return t, t != ""
+	},
+	"extension": func(c *cli.Command, f fileEntry) (interface{}, bool) { return filepath.Ext(f.name), true },
+	"version": func(c *cli.Command, f fileEntry) (interface{}, bool) {
+		ver := extractVersion(f.name)
+		return ver, ver != ""
+	},
+}
+
+// checksumField reads an entry's digest, which is only there when --checksum
+// selected algo. Directories and other non-files have an empty digest.
+func checksumField(algo string) func(c *cli.Command, f fileEntry) (interface{}, bool) {
+	return func(c *cli.Command, f fileEntry) (interface{}, bool) {
+		return f.checksum, c.String("checksum") == algo
+	}
+}
+
+// fieldEntry is a JSON object whose keys keep the order they were added in.
+type fieldEntry []fieldValue
+
+type fieldValue struct {
+	key   string
+	value interface{}
+}
+
+func (e fieldEntry) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, kv := range e {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, err := json.Marshal(kv.key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(kv.value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
 	}
-	b, err := json.MarshalIndent(out, "", "  ")
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// outputCSV prints a header row and then a row for each entry. The columns
+// are name, size, mode and mtime, followed by uid, gid, inode and device when
+// their flags are set and the --checksum digest, unless other fields are
+// chosen with --fields.
+func outputCSV(c *cli.Command, files []fileEntry) error {
+	fields, err := parseFields(c)
 	if err != nil {
 		return err
 	}
-	fmt.Println(string(b))
-	return nil
+	if fields == nil {
+		fields = []string{"name", "size", "mode", "mtime"}
+		for _, opt := range [][2]string{{"show-uid", "uid"}, {"show-gid", "gid"}, {"inodes", "inode"}, {"device", "device"}} {
+			if c.Bool(opt[0]) {
+				fields = append(fields, opt[1])
+			}
+		}
+		if algo := c.String("checksum"); algo != "" {
+			fields = append(fields, algo)
+		}
+	}
+	w := csv.NewWriter(os.Stdout)
+	if err := w.Write(fields); err != nil {
+		return err
+	}
+	for _, f := range files {
+		row := make([]string, len(fields))
+		for i, field := range fields {
+			v, ok := jsonFields[field](c, f)
+			if t, isTime := v.(time.Time); isTime {
+				row[i] = formatTime(c, t)
+			} else if ok {
+				row[i] = fmt.Sprint(v)
+			}
+		}
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// parseFields returns the fields selected with --fields, if any.
+func parseFields(c *cli.Command) ([]string, error) {
+	if c.String("fields") == "" {
+		return nil, nil
+	}
+	fields := strings.Split(c.String("fields"), ",")
+	for i, field := range fields {
+		fields[i] = strings.TrimSpace(field)
+		if _, ok := jsonFields[fields[i]]; !ok {
+			known := make([]string, 0, len(jsonFields))
+			for k := range jsonFields {
+				known = append(known, k)
+			}
+			sort.Strings(known)
+			return nil, fmt.Errorf("unknown field %q, must be one of %s", fields[i], strings.Join(known, ", "))
+		}
+	}
+	return fields, nil
 }
 
 func outputTree(c *cli.Command, fsys fs.FS) error {
+	sortKey := c.String("sort")
+	if sortKey == "time" {
+		sortKey = c.String("time-field")
+	}
 	opts := &tree.Options{
-		Fs:         treeFS{fsys},
+		Fs:         treeFS{fsys: fsys, c: c},
 		All:        c.Bool("all"),
 		DirsOnly:   c.Bool("dirs-only"),
 		FullPath:   c.Bool("full-path"),
@@ -516,132 +2777,919 @@ func outputTree(c *cli.Command, fsys fs.FS) error {
 		Quotes:     c.Bool("quotes"),
 		Inodes:     c.Bool("inodes"),
 		Device:     c.Bool("device"),
-		NoSort:     c.String("sort") == "",
-		ModSort:    c.String("sort") == "mtime",
-		DirSort:    c.Bool("dirs-first"),
+		NoSort:     noSort(c),
+		ModSort:    sortKey == "mtime",
+		DirSort:    c.Bool("dirs-first") || c.String("sort") == "dirs-first",
 		NameSort:   c.String("sort") == "name",
 		SizeSort:   c.String("sort") == "size",
-		CTimeSort:  c.String("sort") == "ctime",
-		//ATimeSort:  c.String("sort") == "atime",
-		//ExtSort:    c.String("sort") == "extension",
 		VerSort:    c.String("sort") == "version",
 		ReverSort:  c.Bool("reverse"),
 		NoIndent:   c.Bool("no-indent"),
-		Colorize:   c.Bool("color"),
+		Colorize:   useColor(c),
 		OutFile:    os.Stdout,
 		Now:        time.Now(),
 	}
 
-	if c.String("sort") == "atime" {
-		return fmt.Errorf("atime sort is unsupported when using `--tree`")
+	if strings.Contains(c.String("sort"), ",") || strings.HasPrefix(c.String("sort"), "-") {
+		return fmt.Errorf("multi-key and descending sorts are unsupported when using `--tree`")
+	}
+	if c.Bool("recursive") {
+		return fmt.Errorf("--recursive is unsupported when using `--tree`")
 	}
-	if c.String("sort") == "extension" {
-		return fmt.Errorf("extension sort is unsupported when using `--tree`")
+	if c.Int("top") > 0 {
+		return fmt.Errorf("--top is unsupported when using `--tree`")
+	}
+	// tree has no atime or extension sort, its ctime sort can't see
+	// archive times, and its version sort is a plain natural sort of the
+	// whole name, so order each directory listing up front and have tree
+	// keep it
+	if sortKey == "atime" || sortKey == "ctime" || sortKey == "extension" || sortKey == "version" {
+		opts.Fs = treeFS{fsys: fsys, c: c, sort: true}
+		opts.NoSort = true
+	}
+
+	// tree's unit sizes are always in units of 1024, so have it print bytes
+	// and format them the way every other listing does
+	var size func(int64) string
+	if opts.UnitSize {
+		opts.ByteSize, opts.UnitSize = true, false
+		size = func(n int64) string { return xpld.FormatBytes(n, unitBase(c)) }
 	}
 
 	n := tree.New(".")
 	n.Visit(opts)
+	var buf bytes.Buffer
+	opts.OutFile = &buf
 	n.Print(opts)
+	out := buf.String()
+	if opts.ByteSize {
+		out = alignTreeColumn(out, size)
+	}
+	if c.Bool("no-trailing-newline") {
+		out = strings.TrimSuffix(out, "\n")
+	}
+	fmt.Print(out)
 	return nil
 }
 
-func outputText(c *cli.Command, files []fileEntry) error {
-	for _, f := range files {
+// alignTreeColumn moves the "[...]" property column that tree prints after
+// each line's indentation to the start of the line, right-justified, so
+// sizes line up in a single column regardless of depth. If size is set, the
+// byte counts are formatted with it. Archive entries have no inode, device
+// or owner tree can read, so their size is always the first property.
+func alignTreeColumn(out string, size func(int64) string) string {
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	type row struct {
+		indent, props, rest string
+		ok                  bool
+	}
+	rows := make([]row, len(lines))
+	width := 0
+	for i, line := range lines {
+		rows[i] = row{rest: line}
+		start := strings.IndexFunc(line, func(r rune) bool { return !strings.ContainsRune("│├└─ ", r) })
+		if start < 0 || line[start] != '[' {
+			continue
+		}
+		end := strings.Index(line[start:], "]  ")
+		if end < 0 {
+			continue
+		}
+		props := strings.TrimSpace(line[start+1 : start+end])
+		if size != nil {
+			num, rest, _ := strings.Cut(props, " ")
+			if n, err := strconv.ParseInt(num, 10, 64); err == nil {
+				props = strings.TrimSpace(size(n) + " " + strings.TrimSpace(rest))
+			}
+		}
+		rows[i] = row{line[:start], props, line[start+end+3:], true}
+		if w := utf8.RuneCountInString(props); w > width {
+			width = w
+		}
+	}
+	var b strings.Builder
+	for _, r := range rows {
+		// Lines without properties, like the report, are left as they are
+		if !r.ok {
+			fmt.Fprintln(&b, r.rest)
+			continue
+		}
+		fmt.Fprintf(&b, "%*s  %s%s\n", width, r.props, r.indent, r.rest)
+	}
+	return b.String()
+}
+
+// topDirs totals the files listed in each top-level directory of the
+// archive for --top-dirs, leaving out those in nested archives.
+func topDirs(entries []xpld.Entry) map[string]*topEntry {
+	tops := map[string]*topEntry{}
+	for _, e := range entries {
+		path := strings.TrimSuffix(e.Name, "/")
+		if e.Nested || path == "." {
+			continue
+		}
+		top, _, nested := strings.Cut(path, "/")
+		if nested || e.Info.IsDir() {
+			top += "/"
+		}
+		t, ok := tops[top]
+		if !ok {
+			t = &topEntry{name: top}
+			tops[top] = t
+		}
+		if !e.Info.IsDir() {
+			t.files++
+			t.size += e.Info.Size()
+		}
+	}
+	return tops
+}
+
+type topEntry struct {
+	name  string
+	files int
+	size  int64
+}
+
+// outputTopDirs prints each top-level entry of the archive with the number
+// of files beneath it and their total size.
+func outputTopDirs(c *cli.Command, tops map[string]*topEntry) error {
+	list := make([]*topEntry, 0, len(tops))
+	for _, t := range tops {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	if c.Bool("json") {
+		out := make([]map[string]interface{}, len(list))
+		for i, t := range list {
+			out[i] = map[string]interface{}{"name": t.name, "files": t.files, "size": t.size}
+		}
+		b, err := json.MarshalIndent(out, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(b))
+		endLine(c, 0, 1)
+		return nil
+	}
+	for i, t := range list {
+		size := fmt.Sprintf("%10d", t.size)
+		if c.Bool("unit-size") {
+			size = fmt.Sprintf("%5s", xpld.FormatBytes(t.size, unitBase(c)))
+		}
+		fmt.Printf("%s %7d files  %s", size, t.files, t.name)
+		endLine(c, i, len(list))
+	}
+	return nil
+}
+
+// outputPorcelain prints one entry per line as mode, size, mtime (unix
+// seconds) and name, separated by tabs. Unlike outputText, this format is
+// kept stable across versions so scripts can rely on it.
+func outputPorcelain(c *cli.Command, files []fileEntry) error {
+	for i, f := range files {
+		fmt.Printf("%s\t%d\t%d\t%s", f.info.Mode(), f.info.Size(), f.info.ModTime().Unix(), f.name)
+		endLine(c, i, len(files))
+	}
+	return nil
+}
+
+// withoutRoot drops the directory the listing is walked from, which isn't
+// one of the archive's entries.
+func withoutRoot(files []fileEntry) []fileEntry {
+	for i, f := range files {
+		if f.info.Name() == "." {
+			return append(files[:i:i], files[i+1:]...)
+		}
+	}
+	return files
+}
+
+// outputTar mimics GNU `tar -tv`: mode, owner/group, size, date and name,
+// with the owner/group and size columns right-aligned together the way tar
+// does it so existing parsers of its output keep working.
+func outputTar(c *cli.Command, files []fileEntry) error {
+	// tar -tv only lists what is in the archive
+	files = withoutRoot(files)
+	ugsWidth := 19
+	for i, f := range files {
+		uid, gid, _, _, _ := xpld.Owner(f.info)
+		user, group := ownerNames(c, f.info)
+		if user == "" {
+			user = strconv.Itoa(uid)
+		}
+		if group == "" {
+			group = strconv.Itoa(gid)
+		}
+		size := strconv.FormatInt(f.info.Size(), 10)
+		pad := len(user) + 1 + len(group) + 1 + len(size)
+		if pad > ugsWidth {
+			ugsWidth = pad
+		}
+		name, mode := f.name, tarMode(f.info.Mode())
+		if hdr, ok := f.info.Sys().(*tar.Header); ok && hdr.Typeflag == tar.TypeLink {
+			name += " link to " + hdr.Linkname
+			mode = "h" + mode[1:]
+		} else if f.info.Mode()&fs.ModeSymlink != 0 {
+			name += " -> " + xpld.LinkTarget(f.info)
+		}
+		fmt.Printf("%s %s/%s %*s %s %s", mode, user, group, ugsWidth-pad+len(size), size,
+			displayTime(c, f.info.ModTime()).Format("2006-01-02 15:04"), name)
+		endLine(c, i, len(files))
+	}
+	return nil
+}
+
+// compressionRatio returns the compressed size of a file over its
+// uncompressed size. Only formats that compress entries individually, like
+// zip, record this; for compressed streams such as tar.gz it isn't known.
+func compressionRatio(info fs.FileInfo) (float64, bool) {
+	zh, ok := info.Sys().(*zip.FileHeader)
+	if !ok || info.IsDir() || zh.UncompressedSize64 == 0 {
+		return 0, false
+	}
+	return float64(zh.CompressedSize64) / float64(zh.UncompressedSize64), true
+}
+
+// outputLong prints an `ls -l` style listing: mode, link count where the
+// format records one, owner, group, size, mtime and name, in aligned columns.
+func outputLong(c *cli.Command, files []fileEntry, sum inspectSummary) error {
+	// Like ls -l, list what is in the archive, not the archive's root
+	files = withoutRoot(files)
+	rows := make([][6]string, len(files))
+	var widths [6]int
+	for i, f := range files {
+		row := &rows[i]
+		row[0] = tarMode(f.info.Mode())
+		if stat, ok := f.info.Sys().(interface{ Nlink() uint64 }); ok {
+			row[1] = strconv.FormatUint(stat.Nlink(), 10)
+		}
+		uid, gid, _, _, ok := xpld.Owner(f.info)
+		user, group := ownerNames(c, f.info)
+		switch {
+		case !ok:
+			user, group = "-", "-"
+		case user == "":
+			user = strconv.Itoa(uid)
+		}
+		if group == "" {
+			group = strconv.Itoa(gid)
+		}
+		row[2], row[3] = user, group
+		if c.Bool("unit-size") {
+			row[4] = xpld.FormatBytes(f.info.Size(), unitBase(c))
+		} else {
+			row[4] = strconv.FormatInt(f.info.Size(), 10)
+		}
+		switch {
+		case c.Bool("relative-time"):
+			row[5] = relativeTime(f.info.ModTime(), time.Now())
+		case c.String("time-format") == "":
+			row[5] = displayTime(c, f.info.ModTime()).Format("2006-01-02 15:04")
+		default:
+			row[5] = formatTime(c, f.info.ModTime())
+		}
+		for j, col := range row {
+			widths[j] = max(widths[j], len(col))
+		}
+	}
+	lines := len(files)
+	if c.Bool("summary") {
+		lines++
+	}
+	for i, f := range files {
+		row := rows[i]
 		name := f.name
-		if c.Bool("color") {
+		if useColor(c) {
 			name = tree.ANSIColor(&tree.Node{FileInfo: f.info}, name)
 		}
-		var parts []string
-		if c.Bool("sizes") {
-			if c.Bool("unit-size") {
-				parts = append(parts, formatBytes(f.info.Size()))
+		if f.info.Mode()&fs.ModeSymlink != 0 {
+			if target := xpld.LinkTarget(f.info); target != "" {
+				name += " -> " + target
 			} else {
-				parts = append(parts, fmt.Sprintf("%10d", f.info.Size()))
+				name += " [symlink]"
 			}
 		}
-		if stat, ok := f.info.Sys().(interface{ Uid() int; Gid() int }); ok {
-			if c.Bool("show-uid") {
-				parts = append(parts, fmt.Sprintf("uid=%d", stat.Uid()))
+		if t := xpld.SpecialType(f.info.Mode()); t != "" {
+			name += " [" + t + "]"
+		}
+		fmt.Printf("%-*s ", widths[0], row[0])
+		if widths[1] > 0 {
+			fmt.Printf("%*s ", widths[1], row[1])
+		}
+		fmt.Printf("%-*s %-*s %*s %-*s %s", widths[2], row[2], widths[3], row[3], widths[4], row[4], widths[5], row[5], name)
+		endLine(c, i, lines)
+	}
+	if c.Bool("summary") {
+		fmt.Print(textSummary(c, sum))
+		endLine(c, lines-1, lines)
+	}
+	return nil
+}
+
+// tarMode formats m the way tar and ls do, unlike fs.FileMode.String.
+func tarMode(m fs.FileMode) string {
+	b := []byte("-rwxrwxrwx")
+	switch {
+	case m.IsDir():
+		b[0] = 'd'
+	case m&fs.ModeSymlink != 0:
+		b[0] = 'l'
+	case m&fs.ModeCharDevice != 0:
+		b[0] = 'c'
+	case m&fs.ModeDevice != 0:
+		b[0] = 'b'
+	case m&fs.ModeNamedPipe != 0:
+		b[0] = 'p'
+	case m&fs.ModeSocket != 0:
+		b[0] = 's'
+	}
+	for i := 0; i < 9; i++ {
+		if m&(1<<uint(8-i)) == 0 {
+			b[i+1] = '-'
+		}
+	}
+	special := func(i int, set bool, c byte) {
+		if !set {
+			return
+		}
+		if b[i] == '-' {
+			c -= 'a' - 'A'
+		}
+		b[i] = c
+	}
+	special(3, m&fs.ModeSetuid != 0, 's')
+	special(6, m&fs.ModeSetgid != 0, 's')
+	special(9, m&fs.ModeSticky != 0, 't')
+	return string(b)
+}
+
+func outputText(c *cli.Command, files []fileEntry, sum inspectSummary) error {
+	lines := len(files)
+	if c.Bool("summary") {
+		lines++
+	}
+	for i, f := range files {
+		fmt.Print(textEntry(c, f))
+		endLine(c, i, lines)
+	}
+	if c.Bool("summary") {
+		fmt.Print(textSummary(c, sum))
+		endLine(c, lines-1, lines)
+	}
+	return nil
+}
+
+// textEntry formats the line outputText prints for f.
+func textEntry(c *cli.Command, f fileEntry) string {
+	name := f.name
+	if useColor(c) {
+		name = tree.ANSIColor(&tree.Node{FileInfo: f.info}, name)
+	}
+	var parts []string
+	if c.Bool("sizes") {
+		if c.Bool("unit-size") {
+			parts = append(parts, xpld.FormatBytes(f.info.Size(), unitBase(c)))
+		} else {
+			parts = append(parts, fmt.Sprintf("%10d", f.info.Size()))
+		}
+	}
+	if uid, gid, _, _, ok := xpld.Owner(f.info); ok {
+		user, group := ownerNames(c, f.info)
+		if c.Bool("show-uid") {
+			if user != "" {
+				parts = append(parts, fmt.Sprintf("uid=%d(%s)", uid, user))
+			} else {
+				parts = append(parts, fmt.Sprintf("uid=%d", uid))
 			}
-			if c.Bool("show-gid") {
-				parts = append(parts, fmt.Sprintf("gid=%d", stat.Gid()))
+		}
+		if c.Bool("show-gid") {
+			if group != "" {
+				parts = append(parts, fmt.Sprintf("gid=%d(%s)", gid, group))
+			} else {
+				parts = append(parts, fmt.Sprintf("gid=%d", gid))
 			}
 		}
-		if c.Bool("last-mod") {
-			parts = append(parts, f.info.ModTime().Format(time.RFC3339))
+	}
+	if c.Bool("last-mod") || c.Bool("relative-time") {
+		parts = append(parts, textTime(c, f.info.ModTime()))
+	}
+	if c.Bool("inodes") {
+		if stat, ok := f.info.Sys().(interface{ Ino() uint64 }); ok {
+			parts = append(parts, fmt.Sprintf("ino=%d", stat.Ino()))
 		}
-		if c.Bool("inodes") {
-			if stat, ok := f.info.Sys().(interface{ Ino() uint64 }); ok {
-				parts = append(parts, fmt.Sprintf("ino=%d", stat.Ino()))
-			}
+	}
+	if c.Bool("device") {
+		if stat, ok := f.info.Sys().(interface{ Dev() uint64 }); ok {
+			parts = append(parts, fmt.Sprintf("dev=%d", stat.Dev()))
 		}
-		if c.Bool("device") {
-			if stat, ok := f.info.Sys().(interface{ Dev() uint64 }); ok {
-				parts = append(parts, fmt.Sprintf("dev=%d", stat.Dev()))
+	}
+	if c.Bool("ctime") {
+		if stat, ok := f.info.Sys().(interface{ Ctime() time.Time }); ok {
+			parts = append(parts, textTime(c, stat.Ctime()))
+		}
+	}
+	if c.Bool("atime") {
+		if stat, ok := f.info.Sys().(interface{ Atime() time.Time }); ok {
+			parts = append(parts, textTime(c, stat.Atime()))
+		}
+	}
+	if f.kind != "" {
+		parts = append(parts, "kind="+f.kind)
+	}
+	if algo := c.String("checksum"); algo != "" {
+		parts = append(parts, algo+"="+f.checksum)
+	}
+	if c.Bool("ratio") {
+		if r, ok := compressionRatio(f.info); ok {
+			parts = append(parts, fmt.Sprintf("ratio=%.2f", r))
+		} else {
+			parts = append(parts, "ratio=n/a")
+		}
+	}
+	if hasSortKey(c, "extension") {
+		parts = append(parts, fmt.Sprintf("ext=%s", filepath.Ext(f.name)))
+	}
+	if hasSortKey(c, "version") {
+		if ver := extractVersion(f.name); ver != "" {
+			parts = append(parts, fmt.Sprintf("ver=%s", ver))
+		}
+	}
+	if t := xpld.SpecialType(f.info.Mode()); t != "" {
+		name += " [" + t + "]"
+	}
+	if len(parts) > 0 {
+		return strings.Join(parts, " ") + " " + name
+	}
+	return name
+}
+
+func textSummary(c *cli.Command, sum inspectSummary) string {
+	size := strconv.FormatInt(sum.Size, 10) + " bytes"
+	if c.Bool("unit-size") {
+		size = xpld.FormatBytes(sum.Size, unitBase(c))
+	}
+	return fmt.Sprintf("%d files, %d directories, %s", sum.Files, sum.Dirs, size)
+}
+
+// entryStream prints entries as inspect finds them, for listings that don't
+// need sorting, so memory use doesn't grow with the archive. The newline
+// ending each line is only written once the next one is, as which entry is
+// last isn't known in advance.
+type entryStream struct {
+	c      *cli.Command
+	fields []string
+	lines  int
+	sum    inspectSummary
+}
+
+func (s *entryStream) line(line string) {
+	if s.lines > 0 {
+		fmt.Println()
+	}
+	fmt.Print(line)
+	s.lines++
+}
+
+func (s *entryStream) print(f fileEntry) error {
+	s.sum.add(f)
+	if !s.c.Bool("ndjson") {
+		s.line(textEntry(s.c, f))
+		return nil
+	}
+	b, err := json.Marshal(jsonEntry(s.c, f, s.fields))
+	if err != nil {
+		return err
+	}
+	s.line(string(b))
+	return nil
+}
+
+func (s *entryStream) finish() error {
+	if s.c.Bool("summary") {
+		if !s.c.Bool("ndjson") {
+			s.line(textSummary(s.c, s.sum))
+		} else {
+			b, err := json.Marshal(map[string]interface{}{"summary": jsonSummary(s.c, s.sum)})
+			if err != nil {
+				return err
 			}
+			s.line(string(b))
 		}
-		if c.Bool("ctime") {
-			if stat, ok := f.info.Sys().(interface{ Ctime() time.Time }); ok {
-				parts = append(parts, stat.Ctime().Format(time.RFC3339))
+	}
+	if s.lines > 0 && !s.c.Bool("no-trailing-newline") {
+		fmt.Println()
+	}
+	return nil
+}
+
+type inspectSummary struct {
+	Files, Dirs int
+	Size        int64
+}
+
+// summarize totals the entries that are being listed.
+func summarize(files []fileEntry) inspectSummary {
+	var sum inspectSummary
+	for _, f := range files {
+		sum.add(f)
+	}
+	return sum
+}
+
+func (sum *inspectSummary) add(f fileEntry) {
+	if f.info.IsDir() {
+		sum.Dirs++
+		return
+	}
+	sum.Files++
+	sum.Size += f.info.Size()
+}
+
+// withSummary wraps the JSON entries in an object alongside their summary
+// when --summary is set, and returns them unchanged otherwise.
+func withSummary(c *cli.Command, sum inspectSummary, entries interface{}) interface{} {
+	if !c.Bool("summary") {
+		return entries
+	}
+	return map[string]interface{}{
+		"entries": entries,
+		"summary": jsonSummary(c, sum),
+	}
+}
+
+func jsonSummary(c *cli.Command, sum inspectSummary) map[string]interface{} {
+	var size interface{} = sum.Size
+	if c.Bool("unit-size") {
+		size = xpld.FormatBytes(sum.Size, unitBase(c))
+	}
+	return map[string]interface{}{"files": sum.Files, "directories": sum.Dirs, "size": size}
+}
+
+// matchPattern reports whether the glob pattern matches the entry at path,
+// which is matched against its base name or its full path within the
+// archive depending on --anchor.
+func matchPattern(c *cli.Command, pattern, path string) bool {
+	return xpld.MatchPattern(pattern, path, c.String("anchor") == "fullpath")
+}
+
+// userNames and groupNames cache ownerNames lookups, since an archive's
+// entries usually share a handful of owners.
+var (
+	userNames  = map[int]string{}
+	groupNames = map[int]string{}
+)
+
+// ownerNames returns the user and group names to display for info: those
+// the archive records, or else the local system's names for its IDs. A name
+// is "" if neither is known, or with --numeric-owner.
+func ownerNames(c *cli.Command, info fs.FileInfo) (user, group string) {
+	uid, gid, user, group, ok := xpld.Owner(info)
+	if !ok || c.Bool("numeric-owner") {
+		return "", ""
+	}
+	if user == "" {
+		name, cached := userNames[uid]
+		if !cached {
+			if u, err := osuser.LookupId(strconv.Itoa(uid)); err == nil {
+				name = u.Username
 			}
+			userNames[uid] = name
 		}
-		if c.Bool("atime") {
-			if stat, ok := f.info.Sys().(interface{ Atime() time.Time }); ok {
-				parts = append(parts, stat.Atime().Format(time.RFC3339))
+		user = name
+	}
+	if group == "" {
+		name, cached := groupNames[gid]
+		if !cached {
+			if g, err := osuser.LookupGroupId(strconv.Itoa(gid)); err == nil {
+				name = g.Name
 			}
+			groupNames[gid] = name
+		}
+		group = name
+	}
+	return user, group
+}
+
+// displayTime converts t to the timezone times are displayed in.
+func displayTime(c *cli.Command, t time.Time) time.Time {
+	if c.Bool("utc") {
+		return t.UTC()
+	}
+	if loc, err := timeLocation(c); err == nil && loc != nil {
+		return t.In(loc)
+	}
+	return t
+}
+
+// timezones caches the locations loaded for --timezone, since loading one
+// reads the tz database.
+var timezones = map[string]*time.Location{}
+
+// timeLocation returns the location named by --timezone, or nil if unset.
+func timeLocation(c *cli.Command) (*time.Location, error) {
+	name := c.String("timezone")
+	if name == "" {
+		return nil, nil
+	}
+	if loc, ok := timezones[name]; ok {
+		return loc, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q, must be UTC, Local or an IANA name such as Europe/Berlin", name)
+	}
+	timezones[name] = loc
+	return loc, nil
+}
+
+// formatTime renders t for text and CSV output, as RFC 3339 unless
+// --time-format says otherwise.
+func formatTime(c *cli.Command, t time.Time) string {
+	t = displayTime(c, t)
+	switch layout := c.String("time-format"); layout {
+	case "", "iso":
+		return t.Format(time.RFC3339)
+	case "unix":
+		return strconv.FormatInt(t.Unix(), 10)
+	case "rfc822":
+		return t.Format(time.RFC822)
+	default:
+		return t.Format(layout)
+	}
+}
+
+// textTime formats t for text output: relative to now with --relative-time,
+// and as formatTime does otherwise.
+func textTime(c *cli.Command, t time.Time) string {
+	if c.Bool("relative-time") {
+		return relativeTime(t, time.Now())
+	}
+	return formatTime(c, t)
+}
+
+// relativeTime describes t relative to now in the largest whole unit, such
+// as "3 days ago" or "in 2 hours", or "-" if t is unset.
+func relativeTime(t, now time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	d := now.Sub(t)
+	future := d < 0
+	if future {
+		d = -d
+	}
+	if d < time.Second {
+		return "just now"
+	}
+	const day = 24 * time.Hour
+	units := []struct {
+		name string
+		size time.Duration
+	}{
+		{"year", 365 * day},
+		{"month", 30 * day},
+		{"day", day},
+		{"hour", time.Hour},
+		{"minute", time.Minute},
+		{"second", time.Second},
+	}
+	for i, u := range units {
+		if d < u.size {
+			continue
 		}
-		if c.String("sort") == "extension" {
-			parts = append(parts, fmt.Sprintf("ext=%s", filepath.Ext(f.name)))
+		// Rounded like git's relative dates, so 2 days 23 hours is 3 days,
+		// and moved up a unit when that rounds to a whole one of it, so
+		// 59 minutes 45 seconds is 1 hour rather than 60 minutes
+		n := int64((d + u.size/2) / u.size)
+		if i > 0 && time.Duration(n)*u.size >= units[i-1].size {
+			n, u = 1, units[i-1]
 		}
-		if c.String("sort") == "version" {
-			if ver := extractVersion(f.name); ver != "" {
-				parts = append(parts, fmt.Sprintf("ver=%s", ver))
-			}
+		s := fmt.Sprintf("%d %s", n, u.name)
+		if n != 1 {
+			s += "s"
 		}
-		if len(parts) > 0 {
-			fmt.Printf("%s %s\n", strings.Join(parts, " "), name)
-		} else {
-			fmt.Println(name)
+		if future {
+			return "in " + s
 		}
+		return s + " ago"
+	}
+	return "just now"
+}
+
+// jsonTime is t as it appears in JSON: a time.Time marshaled as RFC 3339 by
+// default, a number with --time-format unix, or a formatted string.
+func jsonTime(c *cli.Command, t time.Time) interface{} {
+	switch c.String("time-format") {
+	case "":
+		return displayTime(c, t)
+	case "unix":
+		return t.Unix()
+	default:
+		return formatTime(c, t)
+	}
+}
+
+// isTTY reports whether f is a terminal, unless overridden by --force-tty or
+// --no-tty for wrappers and CI systems where detection gives the wrong answer.
+func isTTY(c *cli.Command, f *os.File) bool {
+	switch {
+	case c.Bool("no-tty"):
+		return false
+	case c.Bool("force-tty"):
+		return true
+	}
+	return isTerminal(f)
+}
+
+// isTerminal reports whether f is a character device, as terminals are. It
+// is a variable so that tests can stand in for a terminal.
+var isTerminal = func(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// useColor reports whether output should be colorized. Color is only used
+// when asked for with --color, terminal or not, so that output looks the same
+// wherever it goes unless the user opts in.
+func useColor(c *cli.Command) bool {
+	return c.Bool("color")
+}
+
+// stdout is the process's standard output, which os.Stdout is pointed away
+// from while paging.
+var stdout = os.Stdout
+
+// startPager sends everything written to os.Stdout through $PAGER (less by
+// default) when stdout is a terminal, and returns a function that waits for
+// the pager to exit. Like git, less is run with LESS=FRX unless LESS is set,
+// so output that fits on one screen is printed as is. If the pager can't be
+// started, output goes straight to stdout.
+func startPager(c *cli.Command) func() {
+	if c.Bool("no-pager") || !isTTY(c, stdout) {
+		return func() {}
+	}
+	pager := os.Getenv("PAGER")
+	if pager == "" {
+		pager = "less"
+	}
+	if fields := strings.Fields(pager); len(fields) == 0 || fields[0] == "cat" {
+		return func() {}
+	} else if _, err := exec.LookPath(fields[0]); err != nil {
+		return func() {}
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return func() {}
+	}
+	cmd := exec.Command("sh", "-c", pager)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = r, stdout, os.Stderr
+	cmd.Env = os.Environ()
+	if _, ok := os.LookupEnv("LESS"); !ok {
+		cmd.Env = append(cmd.Env, "LESS=FRX")
+	}
+	if err := cmd.Start(); err != nil {
+		r.Close()
+		w.Close()
+		return func() {}
+	}
+	r.Close()
+	os.Stdout = w
+	return func() {
+		os.Stdout = stdout
+		w.Close()
+		cmd.Wait()
+	}
+}
+
+// endLine terminates the i-th of n output lines, leaving the last one
+// unterminated when --no-trailing-newline is set.
+func endLine(c *cli.Command, i, n int) {
+	if i < n-1 || !c.Bool("no-trailing-newline") {
+		fmt.Println()
 	}
-	return nil
 }
 
+// versionRe matches a semver-like version: v?MAJOR.MINOR[.PATCH...], with
+// optional -pre-release and +build metadata, not run on from a word before it.
+var versionRe = regexp.MustCompile(`(?:^|[^0-9A-Za-z])v?([0-9]+(?:\.[0-9]+)+(?:-[0-9A-Za-z]+(?:[.-][0-9A-Za-z]+)*)?(?:\+[0-9A-Za-z]+(?:\.[0-9A-Za-z]+)*)?)`)
+
+// extractVersion returns the version in a file name, such as "2.0-beta" for
+// my-app-2.0-beta or "1.2.3" for libfoo.1.2.3.tar.gz, or "" if it has none.
+// Extensions that start with a letter (.tar, .gz, .bz2) are dropped first,
+// so they aren't taken for part of the version.
 func extractVersion(name string) string {
-	parts := strings.Split(filepath.Base(name), "-")
-	for _, part := range parts {
-		if strings.Contains(part, ".") && !strings.HasPrefix(part, ".") {
-			return part
-		}
+	name = filepath.Base(name)
+	for ext := filepath.Ext(name); len(ext) > 1 && unicode.IsLetter(rune(ext[1])); ext = filepath.Ext(name) {
+		name = strings.TrimSuffix(name, ext)
+	}
+	if m := versionRe.FindStringSubmatch(name); m != nil {
+		return m[1]
 	}
 	return ""
 }
 
+// compareVersions reports whether version v1 sorts before v2. Numeric parts
+// are compared as numbers, a pre-release sorts before the release itself,
+// and build metadata is ignored. Versions of equal value, like 1.9 and 1.09,
+// are ordered by their zero padding. Any version sorts before no version.
 func compareVersions(v1, v2 string) bool {
-	v1Parts := strings.Split(v1, ".")
-	v2Parts := strings.Split(v2, ".")
-	for i := 0; i < len(v1Parts) && i < len(v2Parts); i++ {
-		n1, _ := strconv.Atoi(v1Parts[i])
-		n2, _ := strconv.Atoi(v2Parts[i])
-		if n1 != n2 {
-			return n1 < n2
+	if v1 == "" || v2 == "" {
+		return v1 != "" && v2 == ""
+	}
+	v1, v2 = strings.SplitN(v1, "+", 2)[0], strings.SplitN(v2, "+", 2)[0]
+	core1, pre1, _ := strings.Cut(v1, "-")
+	core2, pre2, _ := strings.Cut(v2, "-")
+	if r := compareIdentifiers(strings.Split(core1, "."), strings.Split(core2, ".")); r != 0 {
+		return r < 0
+	}
+	if pre1 == "" || pre2 == "" {
+		if pre1 != pre2 {
+			return pre1 != ""
 		}
+	} else if r := compareIdentifiers(strings.FieldsFunc(pre1, isVersionSep), strings.FieldsFunc(pre2, isVersionSep)); r != 0 {
+		return r < 0
 	}
-	return len(v1Parts) < len(v2Parts)
+	return comparePadding(v1, v2) < 0
 }
 
-func formatBytes(i int64) string {
-	var n float64
-	sFmt, eFmt := "%.01f", ""
-	switch {
-	case i >= tree.EB: eFmt, n = "E", float64(i)/float64(tree.EB)
-	case i >= tree.PB: eFmt, n = "P", float64(i)/float64(tree.PB)
-	case i >= tree.TB: eFmt, n = "T", float64(i)/float64(tree.TB)
-	case i >= tree.GB: eFmt, n = "G", float64(i)/float64(tree.GB)
-	case i >= tree.MB: eFmt, n = "M", float64(i)/float64(tree.MB)
-	case i >= tree.KB: eFmt, n = "K", float64(i)/float64(tree.KB)
-	default: sFmt, n = "%.0f", float64(i)
-	}
-	if eFmt != "" && n >= 10 { sFmt = "%.0f" }
-	return strings.Trim(fmt.Sprintf(sFmt+eFmt, n), " ")
+// comparePadding compares the leading zeros of the digit runs of two
+// versions of equal value, run by run. As in tree's natural sort, the run
+// with fewer zeros sorts first, so 1.9 comes before 1.09.
+func comparePadding(v1, v2 string) int {
+	runs1, runs2 := digitRunRe.FindAllString(v1, -1), digitRunRe.FindAllString(v2, -1)
+	for i := 0; i < len(runs1) && i < len(runs2); i++ {
+		zeros1 := len(runs1[i]) - len(strings.TrimLeft(runs1[i], "0"))
+		zeros2 := len(runs2[i]) - len(strings.TrimLeft(runs2[i], "0"))
+		if r := cmp.Compare(zeros1, zeros2); r != 0 {
+			return r
+		}
+	}
+	return 0
+}
+
+var digitRunRe = regexp.MustCompile(`[0-9]+`)
+
+func isVersionSep(r rune) bool { return r == '.' || r == '-' }
+
+// compareIdentifiers compares version parts in order with compareSegment.
+// A list that is a prefix of the other sorts first.
+func compareIdentifiers(a, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if r := compareSegment(a[i], b[i]); r != 0 {
+			return r
+		}
+	}
+	return cmp.Compare(len(a), len(b))
+}
+
+// compareSegment compares two version parts run by run, so that "rc2"
+// sorts before "rc10": runs of digits numerically and other runs
+// lexicographically, with digits before letters as in semver.
+func compareSegment(a, b string) int {
+	for a != "" && b != "" {
+		ra, rb := leadingRun(a), leadingRun(b)
+		a, b = a[len(ra):], b[len(rb):]
+		da, db := isDigit(ra[0]), isDigit(rb[0])
+		var r int
+		switch {
+		case da && db:
+			// Compare digit runs by length without leading zeros, then
+			// digit by digit, which can't overflow like Atoi could
+			na, nb := strings.TrimLeft(ra, "0"), strings.TrimLeft(rb, "0")
+			if r = cmp.Compare(len(na), len(nb)); r == 0 {
+				r = strings.Compare(na, nb)
+			}
+		case da:
+			r = -1
+		case db:
+			r = 1
+		default:
+			r = strings.Compare(ra, rb)
+		}
+		if r != 0 {
+			return r
+		}
+	}
+	return cmp.Compare(len(a), len(b))
+}
+
+// leadingRun returns the run of digits or of non-digits s starts with.
+func leadingRun(s string) string {
+	i := 1
+	for i < len(s) && isDigit(s[i]) == isDigit(s[0]) {
+		i++
+	}
+	return s[:i]
+}
+
+func isDigit(b byte) bool { return '0' <= b && b <= '9' }
+
+// unitBase returns the base sizes are printed and parsed in: 1024 by
+// default, or 1000 with --unit-base 1000.
+func unitBase(c *cli.Command) int64 {
+	if c.Int("unit-base") == 1000 {
+		return 1000
+	}
+	return 1024
 }
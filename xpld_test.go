@@ -0,0 +1,1784 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/urfave/cli/v3"
+	"github.com/xplshn/xpld/pkg/xpld"
+)
+
+var testTime = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// tarEntry is an entry to write into a test archive.
+type tarEntry struct {
+	hdr  *tar.Header
+	body string
+}
+
+func tarFile(name, body string) tarEntry {
+	return tarEntry{&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o644, Size: int64(len(body)), ModTime: testTime}, body}
+}
+
+func tarDir(name string) tarEntry {
+	return tarEntry{hdr: &tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: 0o755, ModTime: testTime}}
+}
+
+func tarSymlink(name, target string) tarEntry {
+	return tarEntry{hdr: &tar.Header{Typeflag: tar.TypeSymlink, Name: name, Linkname: target, Mode: 0o777, ModTime: testTime}}
+}
+
+// writeTar writes entries as an uncompressed tar at path and returns path.
+func writeTar(t *testing.T, path string, entries ...tarEntry) string {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, e := range entries {
+		if err := tw.WriteHeader(e.hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, e.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// readTar returns the names of the entries in the uncompressed tar at path,
+// in archive order, along with the contents of its regular files.
+func readTar(t *testing.T, path string) ([]string, map[string]string) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var names []string
+	bodies := make(map[string]string)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return names, bodies
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		if hdr.Typeflag == tar.TypeReg {
+			b, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bodies[hdr.Name] = string(b)
+		}
+	}
+}
+
+// runXpld runs xpld with args and returns what it wrote to stdout. If stdin
+// isn't nil, it is fed to the command through a pipe.
+func runXpld(t *testing.T, stdin io.Reader, args ...string) (string, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStdout, oldStdin := os.Stdout, os.Stdin
+	os.Stdout, stdout = w, w
+	defer func() { os.Stdout, stdout, os.Stdin = oldStdout, oldStdout, oldStdin }()
+	if stdin != nil {
+		ir, iw, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ir.Close()
+		go func() {
+			io.Copy(iw, stdin)
+			iw.Close()
+		}()
+		os.Stdin = ir
+	}
+	out := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- string(b)
+	}()
+	cancelTimeout := context.CancelFunc(func() {})
+	app := newApp(&cancelTimeout)
+	err = app.Run(context.Background(), stdinArgs(app, append([]string{"xpld"}, args...)))
+	cancelTimeout()
+	w.Close()
+	return <-out, err
+}
+
+// listDir returns the slash-separated paths of everything under dir.
+func listDir(t *testing.T, dir string) []string {
+	t.Helper()
+	var names []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestExtractOnlyRegular(t *testing.T) {
+	dir := t.TempDir()
+	archive := writeTar(t, filepath.Join(dir, "a.tar"),
+		tarDir("d/"),
+		tarFile("d/f", "data"),
+		tarSymlink("d/l", "f"),
+		tarDir("empty/"),
+	)
+	out := filepath.Join(dir, "out")
+	if _, err := runXpld(t, nil, "extract", archive, "-o", out, "--only-regular"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := listDir(t, out), []string{"d", "d/f"}; !equal(got, want) {
+		t.Errorf("extracted %q, want %q", got, want)
+	}
+}
+
+func TestCatRegularOnly(t *testing.T) {
+	dir := t.TempDir()
+	archive := writeTar(t, filepath.Join(dir, "a.tar"),
+		tarDir("d/"),
+		tarFile("d/a", "A\n"),
+		tarSymlink("d/l", "a"),
+		tarFile("d/b", "B\n"),
+	)
+	got, err := runXpld(t, nil, "cat", archive, "d/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "A\nB\n"; got != want {
+		t.Errorf("cat printed %q, want %q", got, want)
+	}
+
+	got, err = runXpld(t, nil, "cat", "--include-all", archive, "d/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "A\nB\na"; got != want {
+		t.Errorf("cat --include-all printed %q, want %q", got, want)
+	}
+
+	if _, err := runXpld(t, nil, "cat", archive, "d/l"); err == nil {
+		t.Error("cat of a named symlink succeeded, want an error")
+	}
+}
+
+func TestSortMtimeTies(t *testing.T) {
+	dir := t.TempDir()
+	at := func(e tarEntry, mtime time.Time) tarEntry {
+		e.hdr.ModTime = mtime
+		return e
+	}
+	archive := writeTar(t, filepath.Join(dir, "a.tar"),
+		tarFile("b", "b"),
+		at(tarFile("c", "c"), testTime.Add(-time.Hour)),
+		tarFile("a", "a"),
+	)
+	for i := 0; i < 3; i++ {
+		got, err := runXpld(t, nil, "inspect", "--sort", "mtime", archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "./\nc\na\nb\n"; got != want {
+			t.Fatalf("inspect --sort mtime printed %q, want %q", got, want)
+		}
+	}
+
+	// With PAX headers the sub-second part is kept and decides the order
+	precise := func(e tarEntry, mtime time.Time) tarEntry {
+		e.hdr.Format = tar.FormatPAX
+		return at(e, mtime)
+	}
+	archive = writeTar(t, filepath.Join(dir, "b.tar"),
+		precise(tarFile("a", "a"), testTime.Add(500*time.Millisecond)),
+		precise(tarFile("b", "b"), testTime.Add(250*time.Millisecond)),
+	)
+	got, err := runXpld(t, nil, "inspect", "--sort", "mtime", archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "./\nb\na\n"; got != want {
+		t.Errorf("inspect --sort mtime printed %q, want %q", got, want)
+	}
+}
+
+func TestCreateDereference(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"src/real", "other"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, body := range map[string]string{"src/real/f": "f", "other/g": "g"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		// Other ways into a directory that's archived anyway aren't loops
+		"src/again": "real",
+		"src/l":     "../other",
+		"src/l2":    "../other",
+		// These lead back to directories the walk is inside of
+		"src/real/up": "..",
+		"src/self":    ".",
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range []struct {
+		mode string
+		want []string
+	}{
+		{"link", []string{"src/", "src/again/", "src/again/f", "src/l/", "src/l/g", "src/l2/", "src/l2/g", "src/real/", "src/real/f"}},
+		{"target", []string{"src/", "src/other/", "src/other/g", "src/real/", "src/real/f"}},
+	} {
+		t.Run(tt.mode, func(t *testing.T) {
+			archive := filepath.Join(dir, tt.mode+".tar")
+			src := filepath.Join(dir, "src")
+			if tt.mode == "target" {
+				// These would be stored twice under the same name
+				os.Remove(filepath.Join(src, "again"))
+				os.Remove(filepath.Join(src, "l2"))
+			}
+			if _, err := runXpld(t, nil, "create", "-H", "--link-name-mode", tt.mode, "-o", archive, src); err != nil {
+				t.Fatal(err)
+			}
+			names, _ := readTar(t, archive)
+			sort.Strings(names)
+			if !equal(names, tt.want) {
+				t.Errorf("archived %q, want %q", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestLongSymlinkTargets(t *testing.T) {
+	dir := t.TempDir()
+	archive := writeTar(t, filepath.Join(dir, "a.tar"),
+		tarFile("f", "data"),
+		tarSymlink("l", "f"),
+		tarSymlink("up", "../elsewhere/g"),
+	)
+	got, err := runXpld(t, nil, "inspect", "--long", archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{" f\n", " l -> f\n", " up -> ../elsewhere/g\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("inspect --long printed %q, want a line ending in %q", got, want)
+		}
+	}
+	if strings.Contains(got, " f ->") {
+		t.Errorf("inspect --long printed a target for a regular file: %q", got)
+	}
+}
+
+func TestParallelExtractStress(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "a.zip")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	want := map[string]string{}
+	var dirs []string
+	for i := 0; i < 40; i++ {
+		// Nest each directory a few levels under an earlier one, and list
+		// it after some of its files so directories can't be relied on to
+		// come first
+		d := fmt.Sprintf("d%d", i)
+		if i > 0 {
+			d = fmt.Sprintf("%s/d%d", dirs[i/3], i)
+		}
+		dirs = append(dirs, d)
+		for j := 0; j < 50; j++ {
+			name := fmt.Sprintf("%s/f%d", d, j)
+			want[name] = strings.Repeat(name, j)
+			hdr := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: testTime}
+			hdr.SetMode(0o644)
+			w, err := zw.CreateHeader(hdr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(w, want[name])
+		}
+		hdr := &zip.FileHeader{Name: d + "/", Modified: testTime.Add(-time.Hour)}
+		hdr.SetMode(0o755 | os.ModeDir)
+		if _, err := zw.CreateHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	out := filepath.Join(dir, "out")
+	if _, err := runXpld(t, nil, "extract", "-j", "16", "--preserve-mtime", "--cleanup-on-error", "--dedup", "-o", out, archive); err != nil {
+		t.Fatal(err)
+	}
+	for name, body := range want {
+		b, err := os.ReadFile(filepath.Join(out, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != body {
+			t.Errorf("%s holds %d bytes, want %d", name, len(b), len(body))
+		}
+	}
+	// Directory times are restored once their files are written
+	for _, d := range dirs {
+		info, err := os.Stat(filepath.Join(out, d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(testTime.Add(-time.Hour)) {
+			t.Errorf("%s has mtime %v, want %v", d, info.ModTime(), testTime.Add(-time.Hour))
+		}
+	}
+}
+
+func TestPatternAnchor(t *testing.T) {
+	dir := t.TempDir()
+	archive := writeTar(t, filepath.Join(dir, "a.tar"),
+		tarDir("src/"),
+		tarFile("src/a.go", ""),
+		tarFile("src/x.txt", ""),
+		tarDir("src/sub/"),
+		tarFile("src/sub/b.go", ""),
+		tarDir("doc/"),
+		tarFile("doc/c.go", ""),
+	)
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--pattern", "*.go"}, "doc/c.go\nsrc/a.go\nsrc/sub/b.go\n"},
+		{[]string{"--pattern", "src/*.go"}, ""},
+		{[]string{"--pattern", "src/*.go", "--anchor", "fullpath"}, "src/a.go\n"},
+		{[]string{"--pattern", "*/*/*.go", "--anchor", "fullpath"}, "src/sub/b.go\n"},
+		{[]string{"--pattern", "s*", "--match-dirs"}, "src/\nsrc/sub/\n"},
+		{[]string{"--ipattern", "sub", "--match-dirs"}, "./\ndoc/\ndoc/c.go\nsrc/\nsrc/a.go\nsrc/x.txt\n"},
+		{[]string{"--ipattern", "src/sub", "--match-dirs", "--anchor", "fullpath"}, "./\ndoc/\ndoc/c.go\nsrc/\nsrc/a.go\nsrc/x.txt\n"},
+	} {
+		got, err := runXpld(t, nil, append(append([]string{"inspect"}, tt.args...), archive)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("inspect %q printed %q, want %q", tt.args, got, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"--pattern", "*.go"}, []string{"doc", "doc/c.go", "src", "src/a.go", "src/sub", "src/sub/b.go"}},
+		{[]string{"--pattern", "src/*.go", "--anchor", "fullpath"}, []string{"src", "src/a.go"}},
+		{[]string{"--ipattern", "sub", "--match-dirs"}, []string{"doc", "doc/c.go", "src", "src/a.go", "src/x.txt"}},
+	} {
+		out := t.TempDir()
+		if _, err := runXpld(t, nil, append(append([]string{"extract", "-o", out}, tt.args...), archive)...); err != nil {
+			t.Fatal(err)
+		}
+		if got := listDir(t, out); !equal(got, tt.want) {
+			t.Errorf("extract %q wrote %q, want %q", tt.args, got, tt.want)
+		}
+	}
+
+	if _, err := runXpld(t, nil, "inspect", "--anchor", "dirname", archive); err == nil {
+		t.Error("inspect --anchor dirname succeeded, want an error")
+	}
+}
+
+// testdata/list.tar was written by GNU tar, and the golden files next to it
+// are what TZ=UTC tar -tvf printed for it, with and without --numeric-owner.
+func TestInspectTarGolden(t *testing.T) {
+	for golden, args := range map[string][]string{
+		"testdata/list.tar.txt":         {"inspect", "--tar", "--utc", "testdata/list.tar"},
+		"testdata/list.tar.numeric.txt": {"inspect", "--tar", "--utc", "--numeric-owner", "testdata/list.tar"},
+	} {
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := runXpld(t, nil, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != string(want) {
+			t.Errorf("%q printed\n%s\nwant, as in %s,\n%s", args, got, golden, want)
+		}
+	}
+}
+
+// writeFiles creates each file under dir, with any parent directories.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, body := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// zipMethods returns the compression method of each file in a zip archive.
+func zipMethods(t *testing.T, path string) map[string]uint16 {
+	t.Helper()
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	methods := make(map[string]uint16)
+	for _, f := range zr.File {
+		methods[f.Name] = f.Method
+	}
+	return methods
+}
+
+func TestStoreCompressedTypes(t *testing.T) {
+	dir := t.TempDir()
+	body := strings.Repeat("compressible ", 100)
+	writeFiles(t, filepath.Join(dir, "src"), map[string]string{"a.txt": body, "b.jpg": body, "c.gz": body})
+	for _, tt := range []struct {
+		flag string
+		want map[string]uint16
+	}{
+		{"--store-compressed-types", map[string]uint16{"src/a.txt": zip.Deflate, "src/b.jpg": zip.Store, "src/c.gz": zip.Store}},
+		{"--store-compressed-types=false", map[string]uint16{"src/a.txt": zip.Deflate, "src/b.jpg": zip.Deflate, "src/c.gz": zip.Deflate}},
+	} {
+		archive := filepath.Join(dir, "a.zip")
+		if _, err := runXpld(t, nil, "create", tt.flag, "-o", archive, filepath.Join(dir, "src")); err != nil {
+			t.Fatal(err)
+		}
+		methods := zipMethods(t, archive)
+		for name, want := range tt.want {
+			if methods[name] != want {
+				t.Errorf("with %s, %s has method %d, want %d", tt.flag, name, methods[name], want)
+			}
+		}
+	}
+}
+
+// tarModes returns the permissions stored for each entry of a tar archive.
+func tarModes(t *testing.T, path string) map[string]os.FileMode {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	modes := make(map[string]os.FileMode)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return modes
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		modes[hdr.Name] = hdr.FileInfo().Mode().Perm()
+	}
+}
+
+func TestCaptureMode(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	writeFiles(t, src, map[string]string{"run": "#!/bin/sh\n", "secret": "", "sub/f": ""})
+	for name, mode := range map[string]os.FileMode{"src": 0o750, "src/run": 0o775, "src/secret": 0o600, "src/sub": 0o700} {
+		if err := os.Chmod(filepath.Join(dir, name), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range []struct {
+		args []string
+		want map[string]os.FileMode
+	}{
+		{nil, map[string]os.FileMode{"src/": 0o750, "src/run": 0o775, "src/secret": 0o600, "src/sub/": 0o700, "src/sub/f": 0o644}},
+		{[]string{"--capture-mode", "default"}, map[string]os.FileMode{"src/": 0o755, "src/run": 0o644, "src/secret": 0o644, "src/sub/": 0o755, "src/sub/f": 0o644}},
+		{[]string{"--capture-mode", "default", "--default-file-mode", "600", "--default-dir-mode", "0700"}, map[string]os.FileMode{"src/": 0o700, "src/run": 0o600, "src/secret": 0o600, "src/sub/": 0o700, "src/sub/f": 0o600}},
+	} {
+		archive := filepath.Join(dir, "a.tar")
+		if _, err := runXpld(t, nil, append(append([]string{"create", "-o", archive}, tt.args...), src)...); err != nil {
+			t.Fatal(err)
+		}
+		modes := tarModes(t, archive)
+		for name, want := range tt.want {
+			if modes[name] != want {
+				t.Errorf("with %q, %s is stored as %v, want %v", tt.args, name, modes[name], want)
+			}
+		}
+	}
+	for _, args := range [][]string{{"--capture-mode", "umask"}, {"--capture-mode", "default", "--default-file-mode", "rw"}} {
+		if _, err := runXpld(t, nil, append(append([]string{"create", "-o", filepath.Join(dir, "b.tar")}, args...), src)...); err == nil {
+			t.Errorf("create %q succeeded, want an error", args)
+		}
+	}
+}
+
+// fakeTerminal makes every file look like a terminal until the test ends.
+func fakeTerminal(t *testing.T) {
+	old := isTerminal
+	isTerminal = func(*os.File) bool { return true }
+	t.Cleanup(func() { isTerminal = old })
+}
+
+func TestTerminal(t *testing.T) {
+	dir := t.TempDir()
+	archive := writeTar(t, filepath.Join(dir, "a.tar"), tarDir("d/"), tarFile("d/f", "data"))
+	fakeTerminal(t)
+
+	// Color stays off on a terminal unless asked for
+	got, err := runXpld(t, nil, "inspect", "--no-pager", archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(got, "\x1b[") {
+		t.Errorf("inspect on a terminal printed color: %q", got)
+	}
+	got, err = runXpld(t, nil, "inspect", "--no-pager", "--color", archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(got, "\x1b[") {
+		t.Errorf("inspect --color printed no color: %q", got)
+	}
+
+	// Archives aren't written to a terminal, unless --no-tty says it isn't one
+	if _, err := runXpld(t, nil, "create", "--format", "tar", "-o", "-", filepath.Join(dir, "a.tar")); err == nil {
+		t.Error("create wrote an archive to a terminal")
+	}
+	if _, err := runXpld(t, nil, "--no-tty", "create", "--format", "tar", "-o", "-", filepath.Join(dir, "a.tar")); err != nil {
+		t.Errorf("create --no-tty: %v", err)
+	}
+	if _, err := runXpld(t, nil, "extract", "--to-tar", archive); err == nil {
+		t.Error("extract --to-tar wrote to a terminal")
+	}
+}
+
+func TestUTC(t *testing.T) {
+	old := time.Local
+	time.Local = time.FixedZone("JST", 9*60*60)
+	t.Cleanup(func() { time.Local = old })
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--last-mod"}, "2023-06-15T18:30:00+09:00 dir/a.txt\n"},
+		{[]string{"--last-mod", "--utc"}, "2023-06-15T09:30:00Z dir/a.txt\n"},
+		{[]string{"--json", "--utc"}, `"mtime": "2023-06-15T09:30:00Z"`},
+		{[]string{"--tar", "--utc"}, " 2023-06-15 09:30 dir/a.txt\n"},
+		{[]string{"--long", "--utc"}, " 2023-06-15 09:30 dir/a.txt\n"},
+	} {
+		got, err := runXpld(t, nil, append(append([]string{"inspect"}, tt.args...), "testdata/list.tar")...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(got, tt.want) {
+			t.Errorf("inspect %q printed %q, want it to contain %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestAlignTreeColumn(t *testing.T) {
+	in := "[      12352]  .\n" +
+		"└── [      12352]  dir\n" +
+		"    ├── [          6]  a.txt\n" +
+		"    └── [          1]  sub\n" +
+		"        └── [          1]  x\n" +
+		"\n" +
+		"2 directories, 2 files\n"
+	want := "12352  .\n" +
+		"12352  └── dir\n" +
+		"    6      ├── a.txt\n" +
+		"    1      └── sub\n" +
+		"    1          └── x\n" +
+		"\n" +
+		"2 directories, 2 files\n"
+	if got := alignTreeColumn(in, nil); got != want {
+		t.Errorf("alignTreeColumn(%q) = %q, want %q", in, got, want)
+	}
+
+	got, err := runXpld(t, nil, "inspect", "--tree", "--sizes", "testdata/list.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every size ends in the same column, whatever its width and depth
+	lines := strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+	for _, line := range lines {
+		if len(line) < 7 || line[4] == ' ' || line[5:7] != "  " {
+			t.Errorf("size not right-aligned in column 5: %q", line)
+		}
+	}
+}
+
+func TestZipLevel(t *testing.T) {
+	dir := t.TempDir()
+	var b strings.Builder
+	for i := 0; b.Len() < 1<<20; i++ {
+		fmt.Fprintf(&b, "line %d of %d: %x\n", i, i*i, i*7919%65521)
+	}
+	body := b.String()
+	writeFiles(t, filepath.Join(dir, "src"), map[string]string{"a.txt": body, "b.png": body})
+	sizes := map[string]int64{}
+	for _, level := range []string{"1", "9", "42"} {
+		archive := filepath.Join(dir, "l"+level+".zip")
+		if _, err := runXpld(t, nil, "create", "--level", level, "-o", archive, filepath.Join(dir, "src")); err != nil {
+			t.Fatalf("create --level %s: %v", level, err)
+		}
+		zr, err := zip.OpenReader(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range zr.File {
+			switch f.Name {
+			case "src/a.txt":
+				sizes[level] = int64(f.CompressedSize64)
+				if f.Method != zip.Deflate {
+					t.Errorf("--level %s: a.txt stored with method %d", level, f.Method)
+				}
+			case "src/b.png":
+				if f.Method != zip.Store {
+					t.Errorf("--level %s: b.png deflated", level)
+				}
+			}
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			r, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			r.Close()
+			if err != nil || string(got) != body {
+				t.Errorf("--level %s: %s doesn't read back: %v", level, f.Name, err)
+			}
+		}
+		zr.Close()
+	}
+	if sizes["9"] >= sizes["1"] {
+		t.Errorf("level 9 deflated to %d bytes, level 1 to %d", sizes["9"], sizes["1"])
+	}
+	// Out-of-range levels are clamped to 9
+	if sizes["42"] != sizes["9"] {
+		t.Errorf("level 42 deflated to %d bytes, level 9 to %d", sizes["42"], sizes["9"])
+	}
+}
+
+func TestCreateExclude(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "proj")
+	writeFiles(t, src, map[string]string{
+		"main.go":             "",
+		"debug.log":           "",
+		"node_modules/x/a.js": "",
+		".git/HEAD":           "",
+		"docs/a.md":           "",
+		"docs/b.log":          "",
+		"build/out":           "",
+	})
+	excludeFile := filepath.Join(dir, "excludes")
+	if err := os.WriteFile(excludeFile, []byte(".git\n\n  docs/*.log\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"--exclude", "node_modules", "--exclude", "*.log"}, []string{"proj/", "proj/.git/", "proj/.git/HEAD", "proj/build/", "proj/build/out", "proj/docs/", "proj/docs/a.md", "proj/main.go"}},
+		// Patterns are matched against the path inside the source too
+		{[]string{"--exclude", "build/out"}, []string{"proj/", "proj/.git/", "proj/.git/HEAD", "proj/build/", "proj/debug.log", "proj/docs/", "proj/docs/a.md", "proj/docs/b.log", "proj/main.go", "proj/node_modules/", "proj/node_modules/x/", "proj/node_modules/x/a.js"}},
+		{[]string{"--exclude-from", excludeFile, "--exclude", "node_modules"}, []string{"proj/", "proj/build/", "proj/build/out", "proj/debug.log", "proj/docs/", "proj/docs/a.md", "proj/main.go"}},
+	} {
+		archive := filepath.Join(dir, "a.tar")
+		if _, err := runXpld(t, nil, append(append([]string{"create", "-o", archive}, tt.args...), src)...); err != nil {
+			t.Fatal(err)
+		}
+		names, _ := readTar(t, archive)
+		sort.Strings(names)
+		if !equal(names, tt.want) {
+			t.Errorf("create %q archived %q, want %q", tt.args, names, tt.want)
+		}
+	}
+	if _, err := runXpld(t, nil, "create", "--exclude", "[", "-o", filepath.Join(dir, "b.tar"), src); err == nil {
+		t.Error("create with a malformed exclude pattern succeeded")
+	}
+}
+
+func TestExtractReadOnlyDirs(t *testing.T) {
+	dir := t.TempDir()
+	mode := func(e tarEntry, m int64) tarEntry {
+		e.hdr.Mode = m
+		return e
+	}
+	archive := writeTar(t, filepath.Join(dir, "a.tar"),
+		mode(tarDir("ro/"), 0o555),
+		mode(tarFile("ro/f", "f"), 0o444),
+		mode(tarDir("ro/sub/"), 0o555),
+		tarFile("ro/sub/g", "g"),
+	)
+	out := filepath.Join(dir, "out")
+	// Let the temporary directory be removed afterwards
+	t.Cleanup(func() {
+		filepath.Walk(out, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.IsDir() {
+				os.Chmod(path, 0o755)
+			}
+			return nil
+		})
+	})
+	if _, err := runXpld(t, nil, "extract", "--preserve-permissions", "-o", out, archive); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]os.FileMode{"ro": 0o555 | os.ModeDir, "ro/f": 0o444, "ro/sub": 0o555 | os.ModeDir, "ro/sub/g": 0o644} {
+		info, err := os.Stat(filepath.Join(out, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode() & (os.ModeDir | os.ModePerm); got != want {
+			t.Errorf("%s has mode %v, want %v", name, got, want)
+		}
+	}
+	if b, err := os.ReadFile(filepath.Join(out, "ro/sub/g")); err != nil || string(b) != "g" {
+		t.Errorf("ro/sub/g holds %q, %v", b, err)
+	}
+}
+
+func TestStdinArgs(t *testing.T) {
+	cancelTimeout := context.CancelFunc(func() {})
+	app := newApp(&cancelTimeout)
+	for _, tt := range []struct{ args, want string }{
+		{"xpld create -o a.tar src", "xpld create -o a.tar src"},
+		{"xpld create - -o l.tar", "xpld create -o l.tar -- -"},
+		{"xpld --no-tty create a - b --level 3 -H", "xpld --no-tty create --level 3 -H -- a - b"},
+		{"xpld extract - -o ./out", "xpld extract -o ./out -- -"},
+		{"xpld e --output=out - --to-tar", "xpld e --output=out --to-tar -- -"},
+		// A "-" that is a flag's value isn't stdin
+		{"xpld create -o - --format tar src", "xpld create -o - --format tar src"},
+		{"xpld create -o - - --format tar", "xpld create -o - --format tar -- -"},
+		{"xpld extract - -- -o", "xpld extract -- - -o"},
+	} {
+		got := strings.Join(stdinArgs(app, strings.Fields(tt.args)), " ")
+		if got != tt.want {
+			t.Errorf("stdinArgs(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestCreateFromList(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a": "A", "sub/b": "B", "c": "C"})
+	t.Chdir(dir)
+	if err := os.WriteFile("list", []byte("c\x00sub/b\x00"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		stdin io.Reader
+		args  []string
+		want  []string
+	}{
+		{strings.NewReader("a\nsub/b\n"), []string{"create", "-", "-o", "l.tar"}, []string{"a", "sub/b"}},
+		{strings.NewReader("sub/b\n"), []string{"create", "-o", "l.tar", "-"}, []string{"sub/b"}},
+		{nil, []string{"create", "@list", "-o", "l.tar"}, []string{"c", "sub/b"}},
+		{strings.NewReader("a\n"), []string{"create", "@list", "-", "-o", "l.tar"}, []string{"c", "sub/b", "a"}},
+	} {
+		if _, err := runXpld(t, tt.stdin, tt.args...); err != nil {
+			t.Fatalf("%q: %v", tt.args, err)
+		}
+		names, _ := readTar(t, "l.tar")
+		if !equal(names, tt.want) {
+			t.Errorf("%q archived %q, want %q", tt.args, names, tt.want)
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	dir := t.TempDir()
+	var entries []tarEntry
+	want := map[string]string{}
+	entries = append(entries, tarDir("d/"), tarSymlink("d/l", "f0"))
+	for i := 0; i < 500; i++ {
+		name := fmt.Sprintf("d/f%d", i)
+		want[name] = strings.Repeat("x", i)
+		entries = append(entries, tarFile(name, want[name]))
+	}
+	archive := writeTar(t, filepath.Join(dir, "a.tar"), entries...)
+
+	for _, ext := range []string{"tar.gz", "zip", "tar.zst"} {
+		converted := filepath.Join(dir, "a."+ext)
+		if _, err := runXpld(t, nil, "convert", archive, "-o", converted); err != nil {
+			t.Fatalf("convert to %s: %v", ext, err)
+		}
+		// archives tells formats apart by any extension in the name
+		back := filepath.Join(dir, "back-"+strings.ReplaceAll(ext, ".", "-")+".tar")
+		if _, err := runXpld(t, nil, "convert", converted, "-o", back); err != nil {
+			t.Fatalf("convert from %s: %v", ext, err)
+		}
+		names, bodies := readTar(t, back)
+		if len(names) != len(entries) || names[0] != "d/" {
+			t.Errorf("%s: round trip gave %d entries starting with %q, want %d starting with d/", ext, len(names), names[0], len(entries))
+		}
+		for name, body := range want {
+			if bodies[name] != body {
+				t.Errorf("%s: %s holds %q, want %q", ext, name, bodies[name], body)
+			}
+		}
+		f, _ := os.Open(back)
+		tr := tar.NewReader(f)
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				break
+			}
+			if hdr.Name == "d/l" && (hdr.Typeflag != tar.TypeSymlink || hdr.Linkname != "f0") {
+				t.Errorf("%s: d/l came back as type %c pointing to %q", ext, hdr.Typeflag, hdr.Linkname)
+			}
+		}
+		f.Close()
+	}
+
+	// A failed conversion leaves no output behind
+	data, err := os.ReadFile(filepath.Join(dir, "a.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated := filepath.Join(dir, "truncated.tar.gz")
+	if err := os.WriteFile(truncated, data[:len(data)/2], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out.zip")
+	if _, err := runXpld(t, nil, "convert", truncated, "-o", out); err == nil {
+		t.Error("converting a truncated archive succeeded")
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("failed conversion left %s behind: %v", out, err)
+	}
+}
+
+func TestExtractModeOverrides(t *testing.T) {
+	dir := t.TempDir()
+	mode := func(e tarEntry, m int64) tarEntry {
+		e.hdr.Mode = m
+		return e
+	}
+	archive := writeTar(t, filepath.Join(dir, "a.tar"),
+		mode(tarDir("d/"), 0o700),
+		mode(tarFile("d/x", "x"), 0o777),
+		mode(tarFile("d/r", "r"), 0o400),
+	)
+	for _, tt := range []struct {
+		args []string
+		want map[string]os.FileMode
+	}{
+		{[]string{"--preserve-permissions"}, map[string]os.FileMode{"d": 0o700, "d/x": 0o777, "d/r": 0o400}},
+		{[]string{"--dir-mode", "0755"}, map[string]os.FileMode{"d": 0o755}},
+		{[]string{"--file-mode", "644"}, map[string]os.FileMode{"d/x": 0o644, "d/r": 0o644}},
+		// The overrides win over the stored modes
+		{[]string{"--preserve-permissions", "--dir-mode", "0750", "--file-mode", "0640"}, map[string]os.FileMode{"d": 0o750, "d/x": 0o640, "d/r": 0o640}},
+	} {
+		out := t.TempDir()
+		if _, err := runXpld(t, nil, append(append([]string{"extract", "-o", out}, tt.args...), archive)...); err != nil {
+			t.Fatal(err)
+		}
+		for name, want := range tt.want {
+			info, err := os.Stat(filepath.Join(out, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := info.Mode().Perm(); got != want {
+				t.Errorf("with %q, %s has mode %v, want %v", tt.args, name, got, want)
+			}
+		}
+	}
+	if _, err := runXpld(t, nil, "extract", "-o", t.TempDir(), "--file-mode", "rwx", archive); err == nil {
+		t.Error("extract with an invalid --file-mode succeeded")
+	}
+}
+
+// extractErr extracts the tar made of entries into dir/out/in and returns
+// the error, if any.
+func extractErr(t *testing.T, dir string, args []string, entries ...tarEntry) error {
+	t.Helper()
+	archive := writeTar(t, filepath.Join(dir, "evil.tar"), entries...)
+	_, err := runXpld(t, nil, append([]string{"extract", "-o", filepath.Join(dir, "out", "in"), archive}, args...)...)
+	return err
+}
+
+func TestExtractPathTraversal(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		entries []tarEntry
+	}{
+		{"dotdot", []tarEntry{tarFile("../pwned.txt", "x")}},
+		{"nested dotdot", []tarEntry{tarFile("a/../../pwned.txt", "x")}},
+		{"absolute", []tarEntry{tarFile("/../pwned.txt", "x")}},
+		// x looks like it stays inside while y doesn't exist yet, but once
+		// y -> . does, x/.. is the output directory's parent
+		{"link to a later link", []tarEntry{tarSymlink("x", "y/.."), tarSymlink("y", "."), tarFile("x/pwned.txt", "x")}},
+		{"dir through a later link", []tarEntry{tarSymlink("p", "q/.."), tarSymlink("q", "."), tarDir("p/d/")}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := extractErr(t, dir, nil, tt.entries...); err == nil || !strings.Contains(err.Error(), "refusing") {
+				t.Errorf("extract returned %v, want a refusal", err)
+			}
+			for _, name := range []string{"pwned.txt", "out/pwned.txt", "out/d"} {
+				if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+					t.Errorf("%s was written outside the output directory", name)
+				}
+			}
+		})
+	}
+
+	// A file entry replaces a link at its own path, which is only followed,
+	// and so refused, without --no-clobber-symlinks
+	link := []tarEntry{tarSymlink("p", "q/../pwned.txt"), tarSymlink("q", "."), tarFile("p", "x")}
+	dir := t.TempDir()
+	if err := extractErr(t, dir, []string{"--no-clobber-symlinks=false"}, link...); err == nil || !strings.Contains(err.Error(), "refusing") {
+		t.Errorf("extract through a later link returned %v, want a refusal", err)
+	}
+	dir = t.TempDir()
+	if err := extractErr(t, dir, nil, link...); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "out", "in", "p")); err != nil || string(b) != "x" {
+		t.Errorf("p holds %q, %v; want the file that replaced the link", b, err)
+	}
+	for _, name := range []string{"pwned.txt", "out/pwned.txt"} {
+		if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("%s was written outside the output directory", name)
+		}
+	}
+
+	// Links already on disk are followed no further than those in the archive
+	dir = t.TempDir()
+	writeFiles(t, dir, map[string]string{"elsewhere/keep": ""})
+	if err := os.MkdirAll(filepath.Join(dir, "out", "in"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "elsewhere"), filepath.Join(dir, "out", "in", "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := extractErr(t, dir, nil, tarFile("link/pwned.txt", "x")); err == nil {
+		t.Error("extracting through a symlink on disk succeeded")
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "elsewhere", "pwned.txt")); err == nil {
+		t.Error("pwned.txt was written through a symlink on disk")
+	}
+
+	// Links that stay inside are still followed, and the output directory
+	// may itself be reached through one
+	dir = t.TempDir()
+	if err := os.Symlink(".", filepath.Join(dir, "self")); err != nil {
+		t.Fatal(err)
+	}
+	archive := writeTar(t, filepath.Join(dir, "ok.tar"), tarDir("d/"), tarSymlink("l", "d"), tarFile("l/f", "f"))
+	if _, err := runXpld(t, nil, "extract", "-o", filepath.Join(dir, "self", "out"), archive); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "out", "d", "f")); err != nil || string(b) != "f" {
+		t.Errorf("d/f holds %q, %v", b, err)
+	}
+
+	// --allow-unsafe-paths lets it all through
+	dir = t.TempDir()
+	if err := extractErr(t, dir, []string{"--allow-unsafe-paths"}, tarFile("../pwned.txt", "x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out", "pwned.txt")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExtractSymlinkTargets(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		entries []tarEntry
+	}{
+		{"dotdot", []tarEntry{tarSymlink("l", "../outside")}},
+		{"absolute", []tarEntry{tarSymlink("l", "/etc/passwd")}},
+		{"deep dotdot", []tarEntry{tarDir("a/"), tarSymlink("a/l", "../../outside")}},
+		// y/.. looks like the output directory, but y -> . makes it its parent
+		{"through an extracted link", []tarEntry{tarSymlink("y", "."), tarSymlink("x", "y/..")}},
+		{"in a linked directory", []tarEntry{tarDir("a/"), tarSymlink("b", "a"), tarSymlink("b/l", "../..")}},
+		{"the reported chain", []tarEntry{tarSymlink("y", "."), tarSymlink("x", "y/.."), tarFile("x/pwned.txt", "x")}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := extractErr(t, dir, nil, tt.entries...); err == nil || !strings.Contains(err.Error(), "refusing") {
+				t.Errorf("extract returned %v, want a refusal", err)
+			}
+			if _, err := os.Lstat(filepath.Join(dir, "out", "pwned.txt")); err == nil {
+				t.Error("pwned.txt was written outside the output directory")
+			}
+		})
+	}
+
+	// Links that resolve inside are created as they are
+	dir := t.TempDir()
+	if err := extractErr(t, dir, nil,
+		tarDir("a/"),
+		tarFile("a/f", "f"),
+		tarSymlink("a/up", ".."),
+		tarSymlink("b", "a"),
+		tarSymlink("c", "b/up/a/f"),
+	); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "out", "in", "c")); err != nil || string(b) != "f" {
+		t.Errorf("c reads %q, %v", b, err)
+	}
+	if target, err := os.Readlink(filepath.Join(dir, "out", "in", "c")); err != nil || target != "b/up/a/f" {
+		t.Errorf("c points to %q, %v", target, err)
+	}
+
+	dir = t.TempDir()
+	if err := extractErr(t, dir, []string{"--allow-unsafe-paths"}, tarSymlink("l", "../outside")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractPipe(t *testing.T) {
+	dir := t.TempDir()
+	archive := writeTar(t, filepath.Join(dir, "a.tar"),
+		tarDir("d/"),
+		tarFile("d/a", "hello\n"),
+		tarFile("d/it's", "quoted\n"),
+		tarSymlink("d/l", "a"),
+	)
+	t.Chdir(t.TempDir())
+	got, err := runXpld(t, nil, "extract", archive, "--pipe", "cat; echo \"[$XPLD_ENTRY]\"")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only regular files are piped, in archive order
+	if want := "hello\n[d/a]\nquoted\n[d/it's]\n"; got != want {
+		t.Errorf("--pipe printed %q, want %q", got, want)
+	}
+	// {} is replaced by the quoted name, even one with a quote in it
+	if err := os.Mkdir("d", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runXpld(t, nil, "extract", archive, "--pipe", "cat > {}.out"); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"d/a.out": "hello\n", "d/it's.out": "quoted\n"} {
+		if b, err := os.ReadFile(name); err != nil || string(b) != want {
+			t.Errorf("%s holds %q, %v; want %q", name, b, err, want)
+		}
+	}
+
+	// The size limits apply to piped files as to written ones
+	for _, args := range [][]string{{"--max-size", "8"}, {"--max-file-size", "6"}, {"--max-files", "1"}} {
+		_, err := runXpld(t, nil, append([]string{"extract", archive, "--pipe", "cat > /dev/null"}, args...)...)
+		if !errors.Is(err, xpld.ErrLimit) {
+			t.Errorf("--pipe with %q returned %v, want a limit error", args, err)
+		}
+	}
+	if _, err := runXpld(t, nil, "extract", archive, "--pipe", "cat > /dev/null", "--max-size", "13"); err != nil {
+		t.Errorf("--pipe within --max-size: %v", err)
+	}
+}
+
+func TestSortKeys(t *testing.T) {
+	dir := t.TempDir()
+	archive := writeTar(t, filepath.Join(dir, "a.tar"),
+		tarFile("a.txt", "aaa"),
+		tarDir("b/"),
+		tarFile("c.go", "c"),
+		tarFile("d.go", "ddd"),
+		tarDir("z/"),
+		tarFile("e.txt", "ee"),
+	)
+	for _, tt := range []struct{ sort, want string }{
+		{"name", "./ a.txt b/ c.go d.go e.txt z/"},
+		{"size", "./ b/ z/ c.go e.txt a.txt d.go"},
+		{"dirs-first,size,name", "./ b/ z/ c.go e.txt a.txt d.go"},
+		// Each key can be reversed on its own
+		{"dirs-first,-size,name", "./ b/ z/ a.txt d.go e.txt c.go"},
+		{"-size,-name", "d.go a.txt e.txt c.go z/ b/ ./"},
+	} {
+		got, err := runXpld(t, nil, "inspect", "--sort", tt.sort, archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(strings.Fields(got), " "); got != tt.want {
+			t.Errorf("--sort %s listed %q, want %q", tt.sort, got, tt.want)
+		}
+	}
+	got, err := runXpld(t, nil, "inspect", "--sort", "dirs-first,size", "--reverse", archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(strings.Fields(got), " "), "d.go a.txt e.txt c.go z/ b/ ./"; got != want {
+		t.Errorf("--reverse listed %q, want %q", got, want)
+	}
+	if _, err := runXpld(t, nil, "inspect", "--sort", "size,colour", archive); err == nil {
+		t.Error("--sort with an unknown key succeeded")
+	}
+}
+
+func TestExtractToTar(t *testing.T) {
+	dir := t.TempDir()
+	archive := writeTar(t, filepath.Join(dir, "a.tar"),
+		tarDir("d/"),
+		tarFile("d/a.txt", "hello\n"),
+		tarFile("d/b.go", "package b\n"),
+		tarSymlink("d/l", "a.txt"),
+		tarFile("c.txt", strings.Repeat("c", 3000)),
+	)
+	toTar := func(stdin io.Reader, args ...string) []string {
+		t.Helper()
+		got, err := runXpld(t, stdin, append([]string{"extract", "--to-tar"}, args...)...)
+		if err != nil {
+			t.Fatalf("extract --to-tar %q: %v", args, err)
+		}
+		out := filepath.Join(t.TempDir(), "out.tar")
+		if err := os.WriteFile(out, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		names, _ := readTar(t, out)
+		return names
+	}
+	all := []string{"d/", "d/a.txt", "d/b.go", "d/l", "c.txt"}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if got := toTar(f, "-"); !equal(got, all) {
+		t.Errorf("--to-tar from stdin wrote %q, want %q", got, all)
+	}
+
+	split := filepath.Join(dir, "s.tar")
+	if _, err := runXpld(t, nil, "create", "--split", "2048", "-o", split, archive); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(split + ".001"); err != nil {
+		t.Fatalf("create --split wrote a single volume: %v", err)
+	}
+	for _, arg := range []string{split, split + ".000"} {
+		if got := toTar(nil, arg); !equal(got, []string{"a.tar"}) {
+			t.Errorf("--to-tar %s wrote %q, want the archived a.tar", filepath.Base(arg), got)
+		}
+	}
+
+	for _, tt := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"--pattern", "*.txt"}, []string{"d/a.txt", "c.txt"}},
+		{[]string{"--regex", `\.go$`}, []string{"d/b.go"}},
+		{[]string{"--only-regular"}, []string{"d/a.txt", "d/b.go", "c.txt"}},
+	} {
+		if got := toTar(nil, append(tt.args, archive)...); !equal(got, tt.want) {
+			t.Errorf("--to-tar %q wrote %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestInspectSpecial(t *testing.T) {
+	special := func(typ byte, name string) tarEntry {
+		return tarEntry{hdr: &tar.Header{Typeflag: typ, Name: name, Mode: 0o660, Devmajor: 1, Devminor: 3, ModTime: testTime}}
+	}
+	archive := writeTar(t, filepath.Join(t.TempDir(), "a.tar"),
+		tarDir("dev/"),
+		special(tar.TypeChar, "dev/null"),
+		special(tar.TypeBlock, "dev/sda"),
+		special(tar.TypeFifo, "fifo"),
+		tarFile("a", "a"),
+	)
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "./ a dev/ dev/null [char device] dev/sda [block device] fifo [fifo]"},
+		{[]string{"--skip-special"}, "./ a dev/"},
+		{[]string{"--tree", "--skip-special"}, ". ├── a └── dev"},
+	} {
+		got, err := runXpld(t, nil, append(append([]string{"inspect"}, tt.args...), archive)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(strings.Fields(got), " "); got != tt.want {
+			t.Errorf("inspect %q listed %q, want %q", tt.args, got, tt.want)
+		}
+	}
+
+	got, err := runXpld(t, nil, "inspect", "--json", archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []map[string]interface{}
+	if err := json.Unmarshal([]byte(got), &entries); err != nil {
+		t.Fatal(err)
+	}
+	types := make(map[string]interface{})
+	for _, e := range entries {
+		if typ, ok := e["type"]; ok {
+			types[e["name"].(string)] = typ
+		}
+	}
+	want := map[string]interface{}{"dev/null": "char device", "dev/sda": "block device", "fifo": "fifo"}
+	if !reflect.DeepEqual(types, want) {
+		t.Errorf("--json types are %v, want %v", types, want)
+	}
+}
+
+func TestUnitBase(t *testing.T) {
+	// --unit-base applies to the sizes given on the command line
+	archive := writeTar(t, filepath.Join(t.TempDir(), "a.tar"),
+		tarFile("small", strings.Repeat("s", 1000)),
+		tarFile("big", strings.Repeat("b", 1024)),
+	)
+	for _, tt := range []struct {
+		base string
+		want string
+	}{
+		{"1024", "./ big small"},
+		{"1000", "./ small"},
+	} {
+		got, err := runXpld(t, nil, "inspect", "--unit-base", tt.base, "--max-size", "1K", archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(strings.Fields(got), " "); got != tt.want {
+			t.Errorf("--unit-base %s --max-size 1K listed %q, want %q", tt.base, got, tt.want)
+		}
+	}
+
+	// The tree's sizes follow it as well
+	for _, tt := range []struct {
+		base string
+		want string
+	}{
+		{"1024", "2.0K . 1.0K ├── big 1000 └── small"},
+		{"1000", "2.0KB . 1.0KB ├── big 1.0KB └── small"},
+	} {
+		got, err := runXpld(t, nil, "--unit-base", tt.base, "inspect", "--tree", "--unit-size", archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(strings.Fields(got), " "); got != tt.want {
+			t.Errorf("--unit-base %s --tree --unit-size printed %q, want %q", tt.base, got, tt.want)
+		}
+	}
+}
+
+func TestExtractStdin(t *testing.T) {
+	archive := writeTar(t, filepath.Join(t.TempDir(), "a.tar"),
+		tarDir("d/"),
+		tarFile("d/a", "hello\n"),
+	)
+	t.Chdir(t.TempDir())
+	// The documented form, with the flags after -, and the others
+	for _, tt := range []struct {
+		args []string
+		out  string
+	}{
+		{[]string{"extract", "-", "-o", "./out"}, "out"},
+		{[]string{"extract", "-o", "./out2", "-"}, "out2"},
+		{[]string{"extract", "-", "--output=./out3"}, "out3"},
+	} {
+		f, err := os.Open(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = runXpld(t, f, tt.args...)
+		f.Close()
+		if err != nil {
+			t.Fatalf("xpld %q: %v", tt.args, err)
+		}
+		if b, err := os.ReadFile(filepath.Join(tt.out, "d/a")); err != nil || string(b) != "hello\n" {
+			t.Errorf("xpld %q wrote %q, %v to d/a", tt.args, b, err)
+		}
+	}
+	f, err := os.Open(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := runXpld(t, f, "extract", "-", "-o", "./sig", "--verify-sig"); err == nil {
+		t.Error("--verify-sig on stdin succeeded")
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	// Each version sorts before the next
+	for _, ordered := range [][]string{
+		{"1.2", "1.10"},
+		{"1.0.0-alpha", "1.0.0"},
+		{"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-beta", "1.0.0-rc1", "1.0.0-rc2", "1.0.0-rc10", "1.0.0"},
+		// Digits sort before letters within a part, as in semver
+		{"1.0.0-1", "1.0.0-a"},
+		{"1.2a", "1.2b", "1.10a"},
+		{"2.0b3", "2.0b12", "2.0rc1"},
+		{"1.9", "1.10", "1.10.1", "2"},
+		{"1.99999999999999999999", "1.100000000000000000000"},
+		{"1", ""},
+	} {
+		for i := 0; i+1 < len(ordered); i++ {
+			a, b := ordered[i], ordered[i+1]
+			if !compareVersions(a, b) || compareVersions(b, a) {
+				t.Errorf("compareVersions(%q, %q) = %v and (%q, %q) = %v, want %q first",
+					a, b, compareVersions(a, b), b, a, compareVersions(b, a), a)
+			}
+		}
+	}
+	// Build metadata doesn't order versions
+	for _, pair := range [][2]string{{"1.0.0+build.1", "1.0.0+build.2"}, {"1.0", "1.0"}, {"", ""}} {
+		if compareVersions(pair[0], pair[1]) || compareVersions(pair[1], pair[0]) {
+			t.Errorf("compareVersions ordered %q and %q, want them equal", pair[0], pair[1])
+		}
+	}
+}
+
+func TestLong(t *testing.T) {
+	got, err := runXpld(t, nil, "inspect", "--long", "--utc", filepath.Join("testdata", "list.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No ./ row for the archive's root, and sizes right-aligned
+	want := `drwxr-xr-x builder developers     0 2023-06-15 09:30 dir/
+-rw-r--r-- builder developers     6 2023-06-15 09:30 dir/a.txt
+-rw-r--r-- builder developers 12345 2023-06-15 09:30 dir/big
+-rw-r--r-- builder developers     0 2023-06-15 09:30 dir/hard
+lrwxrwxrwx builder developers     0 2023-06-15 09:30 dir/link -> a.txt
+drwxr-xr-x builder developers     0 2023-06-15 09:30 dir/sub/
+-rwxr-xr-x builder developers     1 2023-06-15 09:30 dir/sub/x
+`
+	if got != want {
+		t.Errorf("inspect --long printed\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCreateRemovesPartial(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	writeFiles(t, src, map[string]string{
+		"a":     strings.Repeat("a", 4096),
+		"b/bad": "unreadable",
+		"c":     strings.Repeat("c", 4096),
+	})
+	errBad := errors.New("injected read error")
+	open := openSource
+	openSource = func(name string) (*os.File, error) {
+		if filepath.Base(name) == "bad" {
+			return nil, errBad
+		}
+		return open(name)
+	}
+	t.Cleanup(func() { openSource = open })
+
+	t.Chdir(t.TempDir())
+	for _, tt := range []struct {
+		args []string
+		out  string
+	}{
+		{[]string{"-o", "out.tar"}, "out.tar"},
+		{[]string{"-o", "out.tar.gz"}, "out.tar.gz"},
+		{[]string{"-o", "out.zip"}, "out.zip"},
+		{[]string{"-o", "vol.tar", "--split", "1K"}, "vol.tar.000"},
+	} {
+		_, err := runXpld(t, nil, append(append([]string{"create"}, tt.args...), src)...)
+		if !errors.Is(err, errBad) {
+			t.Errorf("create %q returned %v, want the read error", tt.args, err)
+		}
+		if _, err := os.Stat(tt.out); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("create %q left %s behind: %v", tt.args, tt.out, err)
+		}
+	}
+	if _, err := runXpld(t, nil, "create", "-o", "kept.tar", "--keep-partial", src); !errors.Is(err, errBad) {
+		t.Errorf("create --keep-partial returned %v, want the read error", err)
+	}
+	if _, err := os.Stat("kept.tar"); err != nil {
+		t.Errorf("create --keep-partial removed its output: %v", err)
+	}
+}
+
+func TestDepth(t *testing.T) {
+	archive := writeTar(t, filepath.Join(t.TempDir(), "a.tar"),
+		tarFile("top", "t"),
+		tarDir("a/"),
+		tarFile("a/f", "f"),
+		tarDir("a/b/"),
+		tarFile("a/b/g", "g"),
+	)
+	for _, tt := range []struct {
+		depth string
+		want  []string
+	}{
+		// 0 is no limit, and 1 is the top-level entries only
+		{"0", []string{"a", "a/b", "a/b/g", "a/f", "top"}},
+		{"1", []string{"a", "top"}},
+		{"2", []string{"a", "a/b", "a/f", "top"}},
+	} {
+		got, err := runXpld(t, nil, "inspect", "--depth", tt.depth, archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var text []string
+		for _, name := range strings.Fields(got) {
+			if name != "./" {
+				text = append(text, strings.TrimSuffix(name, "/"))
+			}
+		}
+		if !equal(text, tt.want) {
+			t.Errorf("inspect --depth %s listed %q, want %q", tt.depth, text, tt.want)
+		}
+
+		// tree prints each entry's base name, indented one level per
+		// directory, so rebuild the paths from the indentation
+		got, err = runXpld(t, nil, "inspect", "--tree", "--depth", tt.depth, archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var tree, dirs []string
+		for _, line := range strings.Split(strings.TrimSpace(got), "\n")[1:] {
+			name := strings.TrimLeft(line, "│├└─ ")
+			level := utf8.RuneCountInString(line[:len(line)-len(name)])/4 - 1
+			dirs = append(dirs[:level], name)
+			tree = append(tree, strings.Join(dirs, "/"))
+		}
+		sort.Strings(tree)
+		if !equal(tree, tt.want) {
+			t.Errorf("inspect --tree --depth %s listed %q, want %q", tt.depth, tree, tt.want)
+		}
+	}
+}
+
+func TestGrep(t *testing.T) {
+	archive := writeTar(t, filepath.Join(t.TempDir(), "a.tar"),
+		tarFile("a.txt", "one TODO\ntwo\nthree todo\n"),
+		tarDir("d/"),
+		tarFile("d/b.go", "// TODO: b\n"),
+		// The NUL that makes it binary is past the first 4K
+		tarFile("bin", strings.Repeat("x", 5000)+"\x00\nTODO\n"),
+	)
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"TODO"}, "a.txt:1:one TODO\nd/b.go:1:// TODO: b\n"},
+		{[]string{"-i", "TODO"}, "a.txt:1:one TODO\na.txt:3:three todo\nd/b.go:1:// TODO: b\n"},
+		{[]string{"-e", "t[wh]"}, "a.txt:2:two\na.txt:3:three todo\n"},
+		{[]string{"-l", "-i", "todo"}, "a.txt\nd/b.go\n"},
+		{[]string{"--pattern", "*.go", "TODO"}, "d/b.go:1:// TODO: b\n"},
+		{[]string{"--ipattern", "*.go", "TODO"}, "a.txt:1:one TODO\n"},
+		{[]string{"--binary", "text", "-l", "TODO"}, "a.txt\nd/b.go\nbin\n"},
+	} {
+		got, err := runXpld(t, nil, append(append([]string{"grep"}, tt.args...), archive)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("grep %q printed %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestEmptyDirRoundTrip(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	writeFiles(t, src, map[string]string{"full/f": "f"})
+	for _, dir := range []string{"empty", "full/empty"} {
+		if err := os.MkdirAll(filepath.Join(src, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := t.TempDir()
+	for _, ext := range []string{".tar", ".tar.gz", ".zip", ".tar.zst"} {
+		archive := filepath.Join(dir, "out"+ext)
+		if _, err := runXpld(t, nil, "create", "-o", archive, src); err != nil {
+			t.Fatal(err)
+		}
+		out := filepath.Join(dir, "x"+ext)
+		if _, err := runXpld(t, nil, "extract", "-o", out, archive); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"src", "src/empty", "src/full", "src/full/empty", "src/full/f"}
+		if got := listDir(t, out); !equal(got, want) {
+			t.Errorf("%s round-tripped to %q, want %q", ext, got, want)
+		}
+		for _, d := range []string{"src/empty", "src/full/empty"} {
+			if info, err := os.Stat(filepath.Join(out, d)); err != nil || !info.IsDir() {
+				t.Errorf("%s: %s isn't a directory: %v", ext, d, err)
+			}
+		}
+	}
+}
+
+func TestVersionSort(t *testing.T) {
+	for _, tt := range []struct {
+		v1, v2 string
+		want   int
+	}{
+		{"1.9", "1.09", -1},
+		{"1.09", "1.9", 1},
+		{"1.09", "1.09", 0},
+		{"1.009", "1.09", 1},
+		// Only the first run that differs counts
+		{"01.9", "1.09", 1},
+		{"1.0", "1.0.0", 0},
+	} {
+		if got := comparePadding(tt.v1, tt.v2); got != tt.want {
+			t.Errorf("comparePadding(%q, %q) = %d, want %d", tt.v1, tt.v2, got, tt.want)
+		}
+	}
+
+	archive := writeTar(t, filepath.Join(t.TempDir(), "a.tar"),
+		tarFile("pkg-1.10", ""),
+		tarFile("pkg-1.9", ""),
+		tarFile("pkg-1.2", ""),
+		tarFile("pkg-1.09", ""),
+		tarFile("pkg-2.0-rc1", ""),
+		tarFile("pkg-2.0", ""),
+	)
+	want := []string{"pkg-1.2", "pkg-1.9", "pkg-1.09", "pkg-1.10", "pkg-2.0-rc1", "pkg-2.0"}
+	got, err := runXpld(t, nil, "inspect", "--sort", "version", archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each name follows its version, and the root has none so it sorts last
+	var text []string
+	for _, field := range strings.Fields(got) {
+		if !strings.HasPrefix(field, "ver=") && field != "./" {
+			text = append(text, field)
+		}
+	}
+	if !equal(text, want) {
+		t.Errorf("--sort version listed %q, want %q", text, want)
+	}
+	got, err = runXpld(t, nil, "inspect", "--sort", "version", "--tree", archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tree []string
+	for _, line := range strings.Split(strings.TrimSpace(got), "\n")[1:] {
+		tree = append(tree, strings.TrimLeft(line, "├└─ "))
+	}
+	if !equal(tree, want) {
+		t.Errorf("--sort version --tree listed %q, want %q", tree, want)
+	}
+}
+
+func TestFullPath(t *testing.T) {
+	dir := t.TempDir()
+	archive := writeTar(t, filepath.Join(dir, "backup.tar"),
+		tarDir("docs/"),
+		tarDir("docs/api/"),
+		tarFile("docs/api/index.md", "#"),
+	)
+	// Paths are the entries' own, never prefixed with the archive's path
+	got, err := runXpld(t, nil, "inspect", "--full-path", archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "./\ndocs/\ndocs/api/\ndocs/api/index.md\n"; got != want {
+		t.Errorf("inspect --full-path printed %q, want %q", got, want)
+	}
+	got, err = runXpld(t, nil, "inspect", "--full-path", "--tree", archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, line := range strings.Split(strings.TrimSpace(got), "\n") {
+		names = append(names, strings.TrimLeft(line, "│├└─ "))
+	}
+	if want := []string{".", "docs", "docs/api", "docs/api/index.md"}; !equal(names, want) {
+		t.Errorf("inspect --full-path --tree listed %q, want %q", names, want)
+	}
+	if strings.Contains(got, "backup.tar") || strings.Contains(got, dir) {
+		t.Errorf("inspect --full-path --tree printed the archive's path: %q", got)
+	}
+}
+
+func TestRelativeTime(t *testing.T) {
+	const day = 24 * time.Hour
+	for _, tt := range []struct {
+		ago  time.Duration
+		want string
+	}{
+		{0, "just now"},
+		{999 * time.Millisecond, "just now"},
+		{time.Second, "1 second ago"},
+		{59 * time.Second, "59 seconds ago"},
+		{59*time.Second + 600*time.Millisecond, "1 minute ago"},
+		{time.Minute, "1 minute ago"},
+		{90 * time.Second, "2 minutes ago"},
+		{59*time.Minute + 29*time.Second, "59 minutes ago"},
+		{59*time.Minute + 45*time.Second, "1 hour ago"},
+		{time.Hour, "1 hour ago"},
+		{23*time.Hour + 29*time.Minute, "23 hours ago"},
+		{23*time.Hour + 40*time.Minute, "1 day ago"},
+		{day, "1 day ago"},
+		{2*day + 23*time.Hour, "3 days ago"},
+		{29*day + 11*time.Hour, "29 days ago"},
+		{29*day + 13*time.Hour, "1 month ago"},
+		{30 * day, "1 month ago"},
+		{364 * day, "12 months ago"},
+		{365 * day, "1 year ago"},
+		{547 * day, "1 year ago"},
+		{548 * day, "2 years ago"},
+		{-59*time.Minute - 45*time.Second, "in 1 hour"},
+		{-3 * day, "in 3 days"},
+	} {
+		if got := relativeTime(testTime.Add(-tt.ago), testTime); got != tt.want {
+			t.Errorf("relativeTime(now - %v) = %q, want %q", tt.ago, got, tt.want)
+		}
+	}
+	if got := relativeTime(time.Time{}, testTime); got != "-" {
+		t.Errorf("relativeTime of an unset time = %q, want -", got)
+	}
+}
+
+func TestRestoreOwnership(t *testing.T) {
+	euid := geteuid
+	t.Cleanup(func() { geteuid = euid })
+	for _, tt := range []struct {
+		euid int
+		args []string
+		want bool
+	}{
+		{1000, nil, false},
+		{1000, []string{"--same-owner"}, true},
+		{1000, []string{"--same-owner", "--owner-from-current"}, false},
+		{0, nil, true},
+		{0, []string{"--owner-from-current"}, false},
+		{0, []string{"--preserve-ownership=false", "--uid-ownership=false"}, false},
+		{0, []string{"--preserve-ownership=false"}, true},
+	} {
+		geteuid = func() int { return tt.euid }
+		// Run extract's own flag parsing, but only to ask restoreOwnership
+		cancelTimeout := context.CancelFunc(func() {})
+		app := newApp(&cancelTimeout)
+		var got bool
+		for _, cmd := range app.Commands {
+			if cmd.Name == "extract" {
+				cmd.Action = func(ctx context.Context, c *cli.Command) error {
+					got = restoreOwnership(c)
+					return nil
+				}
+			}
+		}
+		args := append(append([]string{"xpld", "extract"}, tt.args...), "a.tar")
+		if err := app.Run(context.Background(), args); err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("restoreOwnership as uid %d with %q = %v, want %v", tt.euid, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestExtractReplacesSymlinks(t *testing.T) {
+	for _, tt := range []struct {
+		name, target string
+	}{
+		{"outside", filepath.Join("..", "outside", "f")},
+		{"inside", "kept"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, map[string]string{"outside/f": "outside", "out/kept": "kept"})
+			if err := os.Symlink(tt.target, filepath.Join(dir, "out", "f")); err != nil {
+				t.Fatal(err)
+			}
+			archive := writeTar(t, filepath.Join(dir, "a.tar"), tarFile("f", "new"))
+			// A symlink at the entry's own path is replaced, not written
+			// through or refused
+			if _, err := runXpld(t, nil, "extract", "-o", filepath.Join(dir, "out"), archive); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Lstat(filepath.Join(dir, "out", "f"))
+			if err != nil || !info.Mode().IsRegular() {
+				t.Fatalf("out/f is %v, %v; want a regular file", info, err)
+			}
+			for name, want := range map[string]string{"out/f": "new", "outside/f": "outside", "out/kept": "kept"} {
+				if b, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(b) != want {
+					t.Errorf("%s holds %q, %v; want %q", name, b, err, want)
+				}
+			}
+		})
+	}
+
+	// Without --no-clobber-symlinks, links are written through, and only
+	// as long as they stay inside
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"outside/f": "outside", "out/kept": "kept"})
+	for name, target := range map[string]string{"f": filepath.Join("..", "outside", "f"), "g": "kept"} {
+		if err := os.Symlink(target, filepath.Join(dir, "out", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := filepath.Join(dir, "out")
+	archive := writeTar(t, filepath.Join(dir, "f.tar"), tarFile("f", "new"))
+	if _, err := runXpld(t, nil, "extract", "--no-clobber-symlinks=false", "-o", out, archive); err == nil {
+		t.Error("extract wrote through a symlink leading outside")
+	}
+	archive = writeTar(t, filepath.Join(dir, "g.tar"), tarFile("g", "new"))
+	if _, err := runXpld(t, nil, "extract", "--no-clobber-symlinks=false", "-o", out, archive); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"outside/f": "outside", "out/kept": "new"} {
+		if b, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(b) != want {
+			t.Errorf("%s holds %q, %v; want %q", name, b, err, want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// fileOwner returns the numeric owner and group of path.
+func fileOwner(t *testing.T, path string) (int, int) {
+	t.Helper()
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := info.Sys().(*syscall.Stat_t)
+	return int(st.Uid), int(st.Gid)
+}
+
+func TestExtractOwnershipAsUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("giving files to another user needs root")
+	}
+	e := tarFile("f", "f")
+	e.hdr.Uid, e.hdr.Gid = 1234, 5678
+	archive := writeTar(t, filepath.Join(t.TempDir(), "a.tar"), e)
+
+	euid := geteuid
+	t.Cleanup(func() { geteuid = euid })
+	for _, tt := range []struct {
+		euid     int
+		args     []string
+		uid, gid int
+	}{
+		// Unprivileged users keep their own ownership, like tar
+		{1000, nil, 0, 0},
+		{1000, []string{"--same-owner"}, 1234, 5678},
+		{0, nil, 1234, 5678},
+		{0, []string{"--owner-from-current"}, 0, 0},
+	} {
+		geteuid = func() int { return tt.euid }
+		dir := t.TempDir()
+		if _, err := runXpld(t, nil, append(append([]string{"extract", "-o", dir}, tt.args...), archive)...); err != nil {
+			t.Fatal(err)
+		}
+		if uid, gid := fileOwner(t, filepath.Join(dir, "f")); uid != tt.uid || gid != tt.gid {
+			t.Errorf("extract as uid %d with %q: f is owned by %d:%d, want %d:%d", tt.euid, tt.args, uid, gid, tt.uid, tt.gid)
+		}
+	}
+}
+
+func TestIgnoreRootOwnership(t *testing.T) {
+	owned := func(name string, uid, gid int) tarEntry {
+		e := tarFile(name, name)
+		e.hdr.Uid, e.hdr.Gid = uid, gid
+		return e
+	}
+	// Entries can only be given to someone else as root, so as anyone else
+	// the other owner is ourselves, and --strict-ownership shows whether a
+	// chown to root was attempted
+	uid, gid := os.Getuid(), os.Getgid()
+	if uid == 0 {
+		uid, gid = 1234, 5678
+	}
+	archive := writeTar(t, filepath.Join(t.TempDir(), "a.tar"),
+		owned("root", 0, 0),
+		owned("user", uid, gid),
+		owned("rootgroup", uid, 0),
+	)
+	dir := t.TempDir()
+	flags := []string{"--same-owner", "--preserve-ownership", "--uid-ownership", "--strict-ownership"}
+	if _, err := runXpld(t, nil, append(append([]string{"extract", "--ignore-root-ownership", "-o", dir}, flags...), archive)...); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name     string
+		uid, gid int
+	}{
+		{"root", os.Geteuid(), os.Getegid()},
+		{"user", uid, gid},
+		{"rootgroup", uid, os.Getegid()},
+	} {
+		if u, g := fileOwner(t, filepath.Join(dir, tt.name)); u != tt.uid || g != tt.gid {
+			t.Errorf("%s is owned by %d:%d, want %d:%d", tt.name, u, g, tt.uid, tt.gid)
+		}
+	}
+
+	_, err := runXpld(t, nil, append(append([]string{"extract", "-o", t.TempDir()}, flags...), archive)...)
+	if os.Geteuid() != 0 && err == nil {
+		t.Error("extract gave files to root without --ignore-root-ownership")
+	}
+	if os.Geteuid() == 0 && err != nil {
+		t.Error(err)
+	}
+}